@@ -1,10 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // checkForSkipFailover skips the calling test if the skipFailover flag has
@@ -15,6 +19,67 @@ func checkForSkipFailover(t *testing.T) {
 	}
 }
 
+// switchBackendsStatus switches the handler of each of backends so that it
+// responds with statusCode and the backend's name as the body.
+func switchBackendsStatus(backends []*CDNBackendServer, statusCode int) {
+	for _, backend := range backends {
+		name := backend.Name
+		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(statusCode)
+			w.Write([]byte(name))
+		})
+	}
+}
+
+// checkResponseCompleteOrError reads the body of resp and asserts that it
+// either matches expectedBody or that the failure was made visible to the
+// client, by an error status code or an error reading the body. A
+// successful response with a silently truncated body is never acceptable.
+func checkResponseCompleteOrError(t *testing.T, resp *http.Response, expectedBody string) {
+	body, err := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode >= 500:
+		t.Logf("Received error status code %d", resp.StatusCode)
+	case err != nil:
+		t.Logf("Received error reading response body: %s", err)
+	case string(body) != expectedBody:
+		t.Errorf(
+			"Received %d response with incomplete body. Expected %d bytes, got %d bytes",
+			resp.StatusCode,
+			len(expectedBody),
+			len(body),
+		)
+	}
+}
+
+// errorPageFingerprint returns text that identifies the static error page
+// served by the edge when all backends are unavailable.
+func errorPageFingerprint() string {
+	switch {
+	case vendorFastly:
+		return "Sorry! We're having issues right now. Please try again later."
+	default:
+		return "Guru Meditation"
+	}
+}
+
+// expectedBackendHost returns the `Host` header that the backend at the
+// given index of backendsByPriority should receive, according to
+// -backendHosts. Backends without an entry should receive -edgeHost.
+func expectedBackendHost(index int) string {
+	if *backendHosts != "" {
+		hosts := strings.Split(*backendHosts, ",")
+		if index < len(hosts) {
+			if host := strings.TrimSpace(hosts[index]); host != "" {
+				return host
+			}
+		}
+	}
+
+	return *edgeHost
+}
+
 // Should serve a known static error page if all backend servers are down
 // and object isn't in cache/stale.
 // NB: ideally this should be a page that we control that has a mechanism
@@ -24,14 +89,7 @@ func TestFailoverErrorPageAllServersDown(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
 	const expectedStatusCode = http.StatusServiceUnavailable
-	var expectedBody string
-
-	switch {
-	case vendorFastly:
-		expectedBody = "Sorry! We're having issues right now. Please try again later."
-	default:
-		expectedBody = "Guru Meditation"
-	}
+	expectedBody := errorPageFingerprint()
 
 	originServer.Stop()
 	backupServer1.Stop()
@@ -63,6 +121,77 @@ func TestFailoverErrorPageAllServersDown(t *testing.T) {
 	}
 }
 
+// Should serve our custom error page, rather than the vendor's default
+// error page, as HTML if all backend servers are down. The error page must
+// not be cached, so the same URL should be served by origin once it has
+// recovered.
+func TestFailoverErrorPageAllServersDownNotCached(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	if !vendorFastly {
+		t.Skip(notImplementedForVendor)
+	}
+
+	const expectedStatusCode = http.StatusServiceUnavailable
+	const expectedContentType = "text/html"
+	const originBody = "origin is back"
+	vendorDefaultPages := []string{
+		"Guru Meditation",
+		"Backend is unhealthy",
+	}
+
+	stopBackends(backendsByPriority)
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatusCode {
+		t.Errorf(
+			"Invalid StatusCode received. Expected %d, got %d",
+			expectedStatusCode,
+			resp.StatusCode,
+		)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, expectedContentType) {
+		t.Errorf(
+			"Received incorrect Content-Type. Expected %q, got %q",
+			expectedContentType,
+			contentType,
+		)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodyStr := string(body)
+	if fingerprint := errorPageFingerprint(); !strings.Contains(bodyStr, fingerprint) {
+		t.Errorf(
+			"Received incorrect response body. Expected to contain %q, got %q",
+			fingerprint,
+			bodyStr,
+		)
+	}
+	for _, vendorDefault := range vendorDefaultPages {
+		if strings.Contains(bodyStr, vendorDefault) {
+			t.Errorf("Received vendor's default error page containing %q", vendorDefault)
+		}
+	}
+
+	ResetBackends(backendsByPriority)
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(originBody))
+	})
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	checkServedByBackend(t, resp, originServer, originBody)
+}
+
 // Should return the 5xx response from the last backup server if all
 // preceeding servers also return a 5xx response.
 func TestFailoverErrorPageAllServers5xx(t *testing.T) {
@@ -111,6 +240,53 @@ func TestFailoverErrorPageAllServers5xx(t *testing.T) {
 	}
 }
 
+// Should make a bounded number of attempts against backends when they all
+// return 5xx responses, so that retries don't amplify load on backends that
+// are already struggling. Each backend should receive at most one attempt
+// per client request.
+func TestFailoverAllServers5xxBoundedRetries(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	const clientRequests = 3
+	const maxAttemptsPerBackend = 1
+
+	for requestCount := 1; requestCount <= clientRequests; requestCount++ {
+		attemptsByBackend := make([]RequestRecorder, len(backendsByPriority))
+
+		for i, backend := range backendsByPriority {
+			name := backend.Name
+			attempts := &attemptsByBackend[i]
+			backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Record()
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(name))
+			})
+		}
+
+		resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+		defer resp.Body.Close()
+
+		var totalAttempts int
+		for i, backend := range backendsByPriority {
+			count := attemptsByBackend[i].Count()
+			totalAttempts += count
+
+			if count > maxAttemptsPerBackend {
+				t.Errorf(
+					"Request %d made too many attempts against %s. Expected at most %d, got %d",
+					requestCount,
+					backend.Name,
+					maxAttemptsPerBackend,
+					count,
+				)
+			}
+		}
+
+		t.Logf("Request %d made %d attempts against backends", requestCount, totalAttempts)
+	}
+}
+
 // Should back off requests against origin for a very short period of time
 // (so as not to overwhelm it) if origin returns a 5xx response.
 func TestFailoverOrigin5xxBackOff(t *testing.T) {
@@ -217,8 +393,145 @@ func TestFailoverOriginDownUseFirstMirror(t *testing.T) {
 	}
 }
 
+// Should fallback to first mirror promptly if origin refuses connections,
+// because its listener has been stopped. The latency added by failover is
+// measured against an uncached request served by origin beforehand, and
+// must be within failoverLatencyBudget.
+func TestFailoverOriginConnRefusedLatency(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "lucky golden ticket"
+	const failoverLatencyBudget = time.Duration(500 * time.Millisecond)
+
+	switchBackendsErrorOnRequest(t, backendsByPriority[2:])
+
+	start := time.Now()
+	resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+	baseline := time.Since(start)
+
+	checkServedByBackend(t, resp, originServer, "")
+
+	originServer.Stop()
+	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	start = time.Now()
+	resp = RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+	failover := time.Since(start)
+
+	checkServedByBackend(t, resp, backupServer1, expectedBody)
+
+	t.Logf("Failover took %s, compared to %s from origin", failover, baseline)
+	if overhead := failover - baseline; overhead > failoverLatencyBudget {
+		t.Errorf(
+			"Failover added too much latency. Expected at most %s, got %s",
+			failoverLatencyBudget,
+			overhead,
+		)
+	}
+}
+
+// Should fallback to first mirror if origin accepts the connection but
+// never responds, once the edge's first byte timeout, given by
+// -firstByteTimeout, has elapsed. The time that the client waited is
+// measured and must not exceed the timeout by more than a small buffer.
+func TestFailoverOriginTimeoutUseFirstMirror(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "lucky golden ticket"
+	const timeoutBuffer = time.Duration(2 * time.Second)
+	maxWait := *firstByteTimeout + timeoutBuffer
+
+	// RoundTripCheckError() would give up before the edge does.
+	timeoutClient := client.Clone()
+	timeoutClient.ResponseHeaderTimeout = maxWait * 2
+
+	originServer.HangRequests()
+	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+	switchBackendsErrorOnRequest(t, backendsByPriority[2:])
+
+	start := time.Now()
+	resp, err := timeoutClient.RoundTrip(NewUniqueEdgeGET(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	waited := time.Since(start)
+
+	checkServedByBackend(t, resp, backupServer1, expectedBody)
+
+	t.Logf("Client waited %s for failover from hung origin", waited)
+	if waited > maxWait {
+		t.Errorf(
+			"Client waited too long for failover. Expected at most %s, got %s",
+			maxWait,
+			waited,
+		)
+	}
+}
+
+// Should return traffic to origin once it comes back up after a failover,
+// within the period given by -healthCheckWindow. Every request in the
+// meantime should be served successfully by either origin or first mirror.
+// The recovery delay is measured for information.
+func TestFailoverOriginRecovery(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	const originBody = "origin is back"
+	const backupBody = "lucky golden ticket"
+	const timeBetweenAttempts = time.Duration(time.Second)
+
+	originServer.Stop()
+	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(backupBody))
+	})
+	switchBackendsErrorOnRequest(t, backendsByPriority[2:])
+
+	resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+	checkServedByBackend(t, resp, backupServer1, backupBody)
+
+	originServer.Start()
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(originBody))
+	})
+
+	start := time.Now()
+	for time.Since(start) < *healthCheckWindow {
+		resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(
+				"Received incorrect status code during recovery. Expected %d, got %d",
+				http.StatusOK,
+				resp.StatusCode,
+			)
+		}
+
+		if resp.Header.Get("Backend-Name") == originServer.Name {
+			t.Logf("Traffic returned to origin after %s", time.Since(start))
+			checkServedByBackend(t, resp, originServer, originBody)
+			return
+		}
+
+		time.Sleep(timeBetweenAttempts)
+	}
+
+	t.Errorf("Traffic didn't return to origin within %s", *healthCheckWindow)
+}
+
 // Should fallback to first mirror if origin returns 5xx response and object
-// is not in cache (active or stale).
+// is not in cache (active or stale). The mirror's response should be
+// returned transparently, without any headers from origin's error response.
 func TestFailoverOrigin5xxUseFirstMirror(t *testing.T) {
 	checkForSkipFailover(t)
 	ResetBackends(backendsByPriority)
@@ -227,9 +540,12 @@ func TestFailoverOrigin5xxUseFirstMirror(t *testing.T) {
 	expectedStatus := http.StatusOK
 	backendsSawRequest := map[string]bool{}
 
+	const originHeaderName = "Origin-Error"
+
 	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
 		name := originServer.Name
 		if !backendsSawRequest[name] {
+			w.Header().Set(originHeaderName, "true")
 			w.WriteHeader(http.StatusServiceUnavailable)
 			backendsSawRequest[name] = true
 		} else {
@@ -264,6 +580,9 @@ func TestFailoverOrigin5xxUseFirstMirror(t *testing.T) {
 			resp.StatusCode,
 		)
 	}
+	if val := resp.Header.Get(originHeaderName); val != "" {
+		t.Errorf("Received %q header from origin's error response: %q", originHeaderName, val)
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -278,6 +597,162 @@ func TestFailoverOrigin5xxUseFirstMirror(t *testing.T) {
 	}
 }
 
+// Should only retry requests with idempotent methods against the first
+// mirror when origin returns a 5xx response. Requests with non-idempotent
+// methods must not be silently replayed, because that could duplicate their
+// side effects, so origin's error should be returned instead:
+// http://tools.ietf.org/html/rfc7231#section-4.2.2
+func TestFailoverOnlyIdempotentMethodsRetried(t *testing.T) {
+	checkForSkipFailover(t)
+
+	const backupBody = "lucky golden ticket"
+	const originStatus = http.StatusServiceUnavailable
+	methodsRetried := map[string]bool{
+		"GET":   true,
+		"POST":  false,
+		"PATCH": false,
+	}
+
+	for method, expectRetry := range methodsRetried {
+		ResetBackends(backendsByPriority)
+		t.Logf("Testing %s request", method)
+
+		var backupRequests RequestRecorder
+
+		switchBackendsStatus(backendsByPriority[:1], originStatus)
+		backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			backupRequests.Record()
+			w.Write([]byte(backupBody))
+		})
+		switchBackendsErrorOnRequest(t, backendsByPriority[2:])
+
+		req := NewUniqueEdgeGET(t)
+		req.Method = method
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if expectRetry {
+			checkServedByBackend(t, resp, backupServer1, backupBody)
+			continue
+		}
+
+		if count := backupRequests.Count(); count != 0 {
+			t.Errorf("%s request was replayed against %s %d times", method, backupServer1.Name, count)
+		}
+		if resp.StatusCode != originStatus {
+			t.Errorf(
+				"%s request received incorrect status code. Expected %d, got %d",
+				method,
+				originStatus,
+				resp.StatusCode,
+			)
+		}
+	}
+}
+
+// Should send a request's body intact to the first mirror when a request
+// is retried because origin returned a 5xx response. The test is skipped if
+// the edge doesn't forward the bodies of GET requests to origin at all.
+func TestFailoverRequestBodyPreserved(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	const backupBody = "lucky golden ticket"
+	reqBody := strings.Repeat("request body to be preserved ", 2000)
+
+	var mutex sync.Mutex
+	receivedBodies := map[string]string{}
+
+	recordBody := func(name string, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Server %s failed to read request body: %s", name, err)
+		}
+
+		mutex.Lock()
+		receivedBodies[name] = string(body)
+		mutex.Unlock()
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		recordBody(originServer.Name, r)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(originServer.Name))
+	})
+	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		recordBody(backupServer1.Name, r)
+		w.Write([]byte(backupBody))
+	})
+	switchBackendsErrorOnRequest(t, backendsByPriority[2:])
+
+	req, err := http.NewRequest("GET", NewUniqueEdgeURL(), strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	checkServedByBackend(t, resp, backupServer1, backupBody)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if receivedBodies[originServer.Name] == "" {
+		t.Skip("Edge doesn't forward GET request bodies")
+	}
+
+	for _, name := range []string{originServer.Name, backupServer1.Name} {
+		if body := receivedBodies[name]; body != reqBody {
+			t.Errorf(
+				"Server %s received incorrect request body. Expected %d bytes, got %d bytes",
+				name,
+				len(reqBody),
+				len(body),
+			)
+		}
+	}
+}
+
+// Should send the expected `Host` header, according to -backendHosts, to
+// each tier of backends as the preceding tiers go down. Mirrors such as S3
+// buckets commonly depend on receiving a particular Host.
+func TestFailoverBackendHostHeaders(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	checkEachBackendTier(t, func(index int, backend *CDNBackendServer, r *http.Request) {
+		if expectedHost := expectedBackendHost(index); r.Host != expectedHost {
+			t.Errorf(
+				"%s received incorrect Host header. Expected %q, got %q",
+				backend.Name,
+				expectedHost,
+				r.Host,
+			)
+		}
+	})
+}
+
+// Should identify each tier of backends by setting the request header
+// named by -backendMarkerHeader to the name of the backend, as the
+// preceding tiers go down.
+func TestFailoverBackendMarkerHeaders(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	if *backendMarkerHeader == "" {
+		t.Skip("Backend marker tests require -backendMarkerHeader")
+	}
+
+	checkEachBackendTier(t, func(index int, backend *CDNBackendServer, r *http.Request) {
+		expectedHeaders := map[string]string{
+			*backendMarkerHeader: backend.Name,
+		}
+		checkRequestHeaders(t, backend.Name, r.Header, expectedHeaders)
+	})
+}
+
 // Should fallback to second mirror if both origin and first mirror are
 // down.
 func TestFailoverOriginDownFirstMirrorDownUseSecondMirror(t *testing.T) {
@@ -384,6 +859,170 @@ func TestFailoverOrigin5xxFirstMirror5xxUseSecondMirror(t *testing.T) {
 	}
 }
 
+// Should handle origin stalling part way through a response body, for
+// longer than -betweenBytesTimeout, by either returning an error to the
+// client or a complete response from a mirror. The partial body must never
+// be cached, so a subsequent request should receive the complete body.
+func TestFailoverOriginStallsBetweenBytes(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	expectedBody := strings.Repeat("lucky golden ticket ", 1000)
+	partialBody := expectedBody[:len(expectedBody)/2]
+	stallDuration := *betweenBytesTimeout + time.Duration(2*time.Second)
+
+	// RoundTripCheckError() would give up before the edge does.
+	stallClient := client.Clone()
+	stallClient.ResponseHeaderTimeout = stallDuration * 2
+
+	var originRequests RequestRecorder
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Header().Set("Content-Length", strconv.Itoa(len(expectedBody)))
+
+		if originRequests.Count() > 1 {
+			w.Write([]byte(expectedBody))
+			return
+		}
+
+		w.Write([]byte(partialBody))
+		w.(http.Flusher).Flush()
+		time.Sleep(stallDuration)
+	})
+	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	resp, err := stallClient.RoundTrip(req)
+	if err != nil {
+		t.Logf("Received error making request: %s", err)
+	} else {
+		defer resp.Body.Close()
+		checkResponseCompleteOrError(t, resp, expectedBody)
+	}
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != expectedBody {
+		t.Errorf(
+			"Subsequent request received incomplete body, which may have been cached. Expected %d bytes, got %d bytes",
+			len(expectedBody),
+			len(body),
+		)
+	}
+}
+
+// Should handle origin dying part way through streaming a chunked response
+// body, before the final chunk, by either returning an error to the client
+// or a complete response from a mirror. The client must never receive a
+// silently truncated 200 response, and the partial body must not be cached.
+func TestFailoverOriginDiesMidStream(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	chunks := []string{
+		"first chunk\n",
+		"second chunk\n",
+		"third chunk\n",
+		"fourth chunk\n",
+	}
+	expectedBody := strings.Join(chunks, "")
+
+	var originRequests RequestRecorder
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+
+		if originRequests.Count() > 1 {
+			w.Header().Set("Cache-Control", "max-age=1800, public")
+			w.Write([]byte(expectedBody))
+			return
+		}
+
+		raw := "HTTP/1.1 200 OK\r\n" +
+			"Cache-Control: max-age=1800, public\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n"
+		for _, chunk := range chunks[:len(chunks)/2] {
+			raw += fmt.Sprintf("%x\r\n%s\r\n", len(chunk), chunk)
+		}
+
+		// Close the connection without sending the remaining chunks or
+		// the terminating zero-length chunk.
+		if err := WriteRawResponse(w, []byte(raw)); err != nil {
+			t.Error(err)
+		}
+	})
+	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+	checkResponseCompleteOrError(t, resp, expectedBody)
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != expectedBody {
+		t.Errorf(
+			"Subsequent request received incomplete body, which may have been cached. Expected %q, got %q",
+			expectedBody,
+			body,
+		)
+	}
+}
+
+// Should serve from the static mirror, the last tier of backends, whenever
+// both origin and first mirror are unavailable, whether because they are
+// down or returning 5xx responses in any combination. The `Backend-Name`
+// header proves which tier served the request.
+func TestFailoverDynamicBackendsUnavailableUseMirror(t *testing.T) {
+	checkForSkipFailover(t)
+
+	const expectedBody = "served from static mirror"
+	breakBackend := map[string]func(backend *CDNBackendServer){
+		"down": func(backend *CDNBackendServer) {
+			backend.Stop()
+		},
+		"5xx": func(backend *CDNBackendServer) {
+			switchBackendsStatus([]*CDNBackendServer{backend}, http.StatusServiceUnavailable)
+		},
+	}
+
+	for _, originState := range []string{"down", "5xx"} {
+		for _, backupState := range []string{"down", "5xx"} {
+			ResetBackends(backendsByPriority)
+			t.Logf("Testing origin %s and first mirror %s", originState, backupState)
+
+			breakBackend[originState](originServer)
+			breakBackend[backupState](backupServer1)
+			backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(expectedBody))
+			})
+
+			resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+			defer resp.Body.Close()
+
+			checkServedByBackend(t, resp, backupServer2, expectedBody)
+		}
+	}
+}
+
 // Should not fallback to mirror if origin returns a 5xx response with a
 // No-Fallback header. In order to allow applications to present their own
 // error pages.
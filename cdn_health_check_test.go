@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Should send health check probes to every backend at least as often as
+// -probeInterval, as `HEAD /` requests with a `Host` header. Vendors may
+// probe from many cache nodes, so only the minimum number of probes is
+// asserted; the observed interval is logged for information.
+func TestHealthCheckProbes(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedMethod = "HEAD"
+	const expectedPath = "/"
+	const minExpectedProbes = 2
+	observeDuration := *probeInterval * 3
+
+	var mutex sync.Mutex
+	probeCounts := map[string]int{}
+
+	for _, backend := range backendsByPriority {
+		name := backend.Name
+		backend.ObserveProbes(func(r *http.Request) {
+			mutex.Lock()
+			probeCounts[name]++
+			mutex.Unlock()
+
+			if r.Method != expectedMethod {
+				t.Errorf(
+					"Probe to %s used incorrect method. Expected %q, got %q",
+					name,
+					expectedMethod,
+					r.Method,
+				)
+			}
+			if r.URL.Path != expectedPath {
+				t.Errorf(
+					"Probe to %s used incorrect path. Expected %q, got %q",
+					name,
+					expectedPath,
+					r.URL.Path,
+				)
+			}
+			if r.Host == "" {
+				t.Errorf("Probe to %s didn't send a Host header", name)
+			}
+		})
+	}
+
+	time.Sleep(observeDuration)
+
+	// Stop observing before the test completes and can no longer fail.
+	for _, backend := range backendsByPriority {
+		backend.ObserveProbes(nil)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, backend := range backendsByPriority {
+		count := probeCounts[backend.Name]
+		if count < minExpectedProbes {
+			t.Errorf(
+				"%s received too few probes in %s. Expected at least %d, got %d",
+				backend.Name,
+				observeDuration,
+				minExpectedProbes,
+				count,
+			)
+			continue
+		}
+
+		t.Logf(
+			"%s received %d probes in %s, an average interval of %s",
+			backend.Name,
+			count,
+			observeDuration,
+			observeDuration/time.Duration(count),
+		)
+	}
+}
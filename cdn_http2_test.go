@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests in this file are only run with -http2, which also makes the rest
+// of the suite use HTTP/2. Run them alone with `-http2 -run TestHTTP2`.
+
+// newHTTP2Client returns a copy of client that negotiates HTTP/2 with ALPN.
+func newHTTP2Client() *http.Transport {
+	h2Client := client.Clone()
+	h2Client.ForceAttemptHTTP2 = true
+
+	return h2Client
+}
+
+// roundTripHTTP2 makes a request with h2Client and asserts that it was made
+// over HTTP/2. If there are any errors then the calling test will be
+// aborted.
+func roundTripHTTP2(t *testing.T, h2Client *http.Transport, req *http.Request) *http.Response {
+	resp, err := h2Client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Request made over incorrect protocol. Expected HTTP/2, got %s", resp.Proto)
+	}
+
+	return resp
+}
+
+// Should pass large and repeated headers intact in both directions, which
+// HPACK header compression will encode from its dynamic table after the
+// first request on the connection.
+func TestHTTP2HeaderCompression(t *testing.T) {
+	checkForSkipHTTP2(t)
+	ResetBackends(backendsByPriority)
+
+	const reqHeaderName = "X-Request-Padding"
+	const respHeaderName = "X-Response-Padding"
+	reqHeaderVal := strings.Repeat("request ", 512)
+	respHeaderVal := strings.Repeat("response ", 512)
+
+	var receivedHeaderVal string
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaderVal = r.Header.Get(reqHeaderName)
+		w.Header().Set(respHeaderName, respHeaderVal)
+	})
+
+	h2Client := newHTTP2Client()
+
+	for requestCount := 1; requestCount < 6; requestCount++ {
+		receivedHeaderVal = ""
+
+		req := NewUniqueEdgeGET(t)
+		req.Header.Set(reqHeaderName, reqHeaderVal)
+
+		resp := roundTripHTTP2(t, h2Client, req)
+		resp.Body.Close()
+
+		if receivedHeaderVal != reqHeaderVal {
+			t.Errorf(
+				"Origin received incorrect %q header in request #%d. Expected %d bytes, got %d",
+				reqHeaderName,
+				requestCount,
+				len(reqHeaderVal),
+				len(receivedHeaderVal),
+			)
+		}
+		if val := resp.Header.Get(respHeaderName); val != respHeaderVal {
+			t.Errorf(
+				"Received incorrect %q header in response #%d. Expected %d bytes, got %d",
+				respHeaderName,
+				requestCount,
+				len(respHeaderVal),
+				len(val),
+			)
+		}
+	}
+}
+
+// Should serve concurrent requests as streams on a single connection,
+// without one slow response blocking the others. Origin waits for a delay
+// before each response, so the requests should take little more than one
+// delay in total.
+func TestHTTP2StreamMultiplexing(t *testing.T) {
+	checkForSkipHTTP2(t)
+	ResetBackends(backendsByPriority)
+
+	const concurrency = 10
+	const responseDelay = time.Duration(500 * time.Millisecond)
+	const maxDuration = responseDelay * 2
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(responseDelay)
+	})
+
+	h2Client := newHTTP2Client()
+
+	// Establish the connection first, so that concurrent requests don't
+	// race to open their own.
+	resp := roundTripHTTP2(t, h2Client, NewUniqueEdgeGET(t))
+	resp.Body.Close()
+
+	var mutex sync.Mutex
+	conns := map[*tls.Conn]bool{}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn, ok := info.Conn.(*tls.Conn); ok {
+				mutex.Lock()
+				conns[conn] = true
+				mutex.Unlock()
+			}
+		},
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i := 0; i < concurrency; i++ {
+		req := NewUniqueEdgeGET(t)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := h2Client.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+				t.Errorf(
+					"Received incorrect response. Expected 200 over HTTP/2, got %d over %s",
+					resp.StatusCode,
+					resp.Proto,
+				)
+			}
+		}()
+	}
+
+	wg.Wait()
+	duration := time.Since(start)
+
+	if count := len(conns); count != 1 {
+		t.Errorf("Concurrent requests used incorrect number of connections. Expected 1, got %d", count)
+	}
+	if duration > maxDuration {
+		t.Errorf(
+			"Concurrent requests weren't multiplexed. Expected at most %s, took %s",
+			maxDuration,
+			duration,
+		)
+	}
+}
+
+// Should translate HTTP/2 pseudo-headers into the method, request-target
+// and `Host` of the request to origin, without passing any of them through
+// as headers.
+func TestHTTP2PseudoHeadersAtOrigin(t *testing.T) {
+	checkForSkipHTTP2(t)
+	ResetBackends(backendsByPriority)
+
+	const expectedMethod = "GET"
+	var receivedReq *http.Request
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedReq = r
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := roundTripHTTP2(t, newHTTP2Client(), req)
+	defer resp.Body.Close()
+
+	if receivedReq == nil {
+		t.Fatal("Origin didn't receive request")
+	}
+
+	if receivedReq.Method != expectedMethod {
+		t.Errorf(
+			"Origin received incorrect method. Expected %q, got %q",
+			expectedMethod,
+			receivedReq.Method,
+		)
+	}
+	if uri := receivedReq.URL.RequestURI(); uri != req.URL.RequestURI() {
+		t.Errorf(
+			"Origin received incorrect request-target. Expected %q, got %q",
+			req.URL.RequestURI(),
+			uri,
+		)
+	}
+	if receivedReq.Host != *edgeHost {
+		t.Errorf(
+			"Origin received incorrect Host header. Expected %q, got %q",
+			*edgeHost,
+			receivedReq.Host,
+		)
+	}
+	for headerName := range receivedReq.Header {
+		if strings.HasPrefix(headerName, ":") {
+			t.Errorf("Origin received pseudo-header %q as a header", headerName)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+//go:build http3
+// +build http3
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	// Aliased because of the http3 flag.
+	quichttp3 "github.com/quic-go/quic-go/http3"
+)
+
+// Tests in this file make requests to the edge over HTTP/3. They depend on
+// quic-go, so are only built with `-tags http3`, and are skipped unless
+// -http3 is set. The QUIC client does its own DNS lookups, so may not
+// always reach the same edge location as client.
+
+// newHTTP3Client returns a transport for requests to the edge over HTTP/3,
+// which honours -skipVerifyTLS. It must be closed by the caller.
+func newHTTP3Client() *quichttp3.Transport {
+	return &quichttp3.Transport{
+		TLSClientConfig: newEdgeTLSConfig(),
+	}
+}
+
+// roundTripHTTP3 makes a request with h3Client and asserts that it was made
+// over HTTP/3. If there are any errors then the calling test will be
+// aborted.
+func roundTripHTTP3(t *testing.T, h3Client *quichttp3.Transport, req *http.Request) *http.Response {
+	resp, err := h3Client.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ProtoMajor != 3 {
+		t.Errorf("Request made over incorrect protocol. Expected HTTP/3, got %s", resp.Proto)
+	}
+
+	return resp
+}
+
+// checkForSkipHTTP3 skips the calling test if the http3 flag hasn't been
+// set.
+func checkForSkipHTTP3(t *testing.T) {
+	if !*http3 {
+		t.Skip("HTTP/3 tests require -http3")
+	}
+}
+
+// Should serve responses from origin over HTTP/3.
+func TestHTTP3ServesResponses(t *testing.T) {
+	checkForSkipHTTP3(t)
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "quick as a flash"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	h3Client := newHTTP3Client()
+	defer h3Client.Close()
+
+	resp := roundTripHTTP3(t, h3Client, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+
+	checkServedByBackend(t, resp, originServer, expectedBody)
+}
+
+// Should advertise HTTP/3 on the same port to clients using TCP, with an
+// `Alt-Svc` header of the form `h3=":443"`, so that they can upgrade.
+func TestHTTP3AltSvc(t *testing.T) {
+	checkForSkipHTTP3(t)
+	ResetBackends(backendsByPriority)
+
+	const expectedAltSvc = `h3=":443"`
+
+	resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+
+	altSvc := resp.Header.Get("Alt-Svc")
+	if !strings.Contains(altSvc, expectedAltSvc) {
+		t.Errorf(
+			"Alt-Svc header doesn't advertise HTTP/3. Expected to contain %q, got %q",
+			expectedAltSvc,
+			altSvc,
+		)
+	}
+}
+
+// Should share cached objects between HTTP/3 and HTTP/1.1, and treat
+// `Cache-Control` identically, so that upgrading clients doesn't change
+// cache behaviour. Each URL is requested over HTTP/3 and then over client.
+func TestHTTP3CacheBehaviourMatchesHTTP1(t *testing.T) {
+	checkForSkipHTTP3(t)
+	ResetBackends(backendsByPriority)
+
+	h3Client := newHTTP3Client()
+	defer h3Client.Close()
+
+	cacheControls := []struct {
+		Value         string
+		ExpectedCount int
+	}{
+		{"max-age=1800, public", 1},
+		{"private", 2},
+	}
+
+	for _, cacheControl := range cacheControls {
+		var requests RequestRecorder
+		value := cacheControl.Value
+
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			requests.Record()
+			w.Header().Set("Cache-Control", value)
+			w.Write([]byte(NewUUID()))
+		})
+
+		url := NewUniqueEdgeURL()
+
+		resp := roundTripHTTP3(t, h3Client, NewEdgeRequest(t, "GET", url))
+		h3Body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp = RoundTripCheckError(t, NewEdgeRequest(t, "GET", url))
+		h1Body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count := requests.Count(); count != cacheControl.ExpectedCount {
+			t.Errorf(
+				"Origin received incorrect number of requests for %q. Expected %d, got %d",
+				value,
+				cacheControl.ExpectedCount,
+				count,
+			)
+		}
+		if cached := string(h1Body) == string(h3Body); cached != (cacheControl.ExpectedCount == 1) {
+			t.Errorf(
+				"HTTP/1.1 and HTTP/3 responses for %q were inconsistently cached. Got %q and %q",
+				value,
+				h1Body,
+				h3Body,
+			)
+		}
+	}
+}
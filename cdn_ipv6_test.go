@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Tests in this file are a smoke subset for -ipv6, which makes every test
+// connect to the edge over IPv6. Run them with `-ipv6 -run TestIPv6`.
+
+// checkForSkipIPv6 skips the calling test if the ipv6 flag hasn't been
+// set.
+func checkForSkipIPv6(t *testing.T) {
+	if !*ipv6 {
+		t.Skip("IPv6 tests require -ipv6")
+	}
+}
+
+// Should be connected to over IPv6.
+func TestIPv6EdgeAddress(t *testing.T) {
+	checkForSkipIPv6(t)
+
+	conn, err := client.Dial("tcp", net.JoinHostPort(*edgeHost, "443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+		t.Errorf("Connected to edge over incorrect protocol. Expected IPv6, got %q", host)
+	}
+}
+
+// Should cache objects requested over IPv6 as it does over IPv4.
+func TestIPv6CacheParity(t *testing.T) {
+	checkForSkipIPv6(t)
+	ResetBackends(backendsByPriority)
+
+	testRequestsCachedIndefinite(t, NewUniqueEdgeGET(t), nil, http.StatusOK)
+
+	testRequestsNotCached(t, NewUniqueEdgeGET(t), func(w http.ResponseWriter) {
+		w.Header().Set("Cache-Control", "private")
+	}, http.StatusOK)
+}
+
+// Should send the client's IPv6 address to origin in `True-Client-IP` and
+// as the first address in `X-Forwarded-For`. The client's address is the
+// local address of a connection to the edge, because IPv6 isn't normally
+// translated.
+func TestIPv6ClientIPHeaders(t *testing.T) {
+	checkForSkipIPv6(t)
+	ResetBackends(backendsByPriority)
+
+	conn, err := client.Dial("tcp", net.JoinHostPort(*edgeHost, "443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	conn.Close()
+	expectedIP := net.ParseIP(host)
+
+	var receivedHeaders http.Header
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header
+	})
+
+	resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+
+	if receivedHeaders == nil {
+		t.Fatal("Origin didn't receive request")
+	}
+
+	xffVals := strings.Split(receivedHeaders.Get("X-Forwarded-For"), ",")
+	headerVals := map[string]string{
+		"True-Client-IP":  receivedHeaders.Get("True-Client-IP"),
+		"X-Forwarded-For": strings.TrimSpace(xffVals[0]),
+	}
+
+	for headerName, val := range headerVals {
+		if ip := net.ParseIP(val); !ip.Equal(expectedIP) {
+			t.Errorf(
+				"Origin received %q header without client's IPv6 address. Expected %q, got %q",
+				headerName,
+				expectedIP,
+				val,
+			)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Large objects are generated and checksummed as streams, rather than
+// being held in memory, because they may be larger than the memory
+// available to the tests.
+
+// largeObjectTimeout allows the edge to fetch the whole object from origin
+// before sending response headers, as some vendors do.
+const largeObjectTimeout = time.Minute * 10
+
+// checkForLargeObjects skips the calling test if the largeObjects flag
+// hasn't been set.
+func checkForLargeObjects(t *testing.T) {
+	if !*largeObjects {
+		t.Skip("Large object tests require -largeObjects")
+	}
+}
+
+// newLargeObjectReader returns a reader of size bytes of pseudo-random data.
+// The same seed always produces the same data, so that it can be generated
+// again to verify what was received.
+func newLargeObjectReader(seed int64, size int64) io.Reader {
+	return io.LimitReader(rand.New(rand.NewSource(seed)), size)
+}
+
+// largeObjectChecksum returns the SHA-256 checksum of a reader.
+func largeObjectChecksum(r io.Reader) ([]byte, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// Should cache large objects and serve them with the correct
+// `Content-Length` and byte-exact bodies for both the initial request and
+// subsequent requests from cache.
+func TestLargeObjectsCached(t *testing.T) {
+	checkForLargeObjects(t)
+	ResetBackends(backendsByPriority)
+
+	const requestsExpectedCount = 1
+	sizes := []int64{
+		100 << 20, // 100MB
+		1 << 30,   // 1GB
+		2 << 30,   // 2GB
+	}
+
+	largeClient := client.Clone()
+	largeClient.ResponseHeaderTimeout = largeObjectTimeout
+
+	for _, size := range sizes {
+		var originRequests int64
+		seed := time.Now().UnixNano()
+
+		expectedChecksum, err := largeObjectChecksum(newLargeObjectReader(seed, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&originRequests, 1)
+
+			w.Header().Set("Cache-Control", "max-age=1800, public")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.Copy(w, newLargeObjectReader(seed, size))
+		})
+
+		req := NewUniqueEdgeGET(t)
+
+		for requestCount := 1; requestCount < 3; requestCount++ {
+			// RoundTripCheckError() would consider these slow requests.
+			resp, err := largeClient.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.ContentLength != size {
+				t.Errorf(
+					"Request %d for %d byte object received incorrect Content-Length. Expected %d, got %d",
+					requestCount,
+					size,
+					size,
+					resp.ContentLength,
+				)
+			}
+
+			checksum, err := largeObjectChecksum(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(checksum, expectedChecksum) {
+				t.Errorf(
+					"Request %d for %d byte object received incorrect body. Expected SHA-256 %x, got %x",
+					requestCount,
+					size,
+					expectedChecksum,
+					checksum,
+				)
+			}
+		}
+
+		if count := atomic.LoadInt64(&originRequests); count != requestsExpectedCount {
+			t.Errorf(
+				"Origin received the wrong number of requests for %d byte object. Expected %d, got %d",
+				size,
+				requestsExpectedCount,
+				count,
+			)
+		}
+	}
+}
+
+// Should report the largest object size that the edge will cache, by
+// binary-searching between minProbeSize and maxProbeSize to a resolution of
+// probeResolution. Only the smallest size is asserted to be cacheable; the
+// discovered threshold is logged for information.
+func TestLargeObjectsMaxCacheableSize(t *testing.T) {
+	checkForLargeObjects(t)
+	ResetBackends(backendsByPriority)
+
+	const minProbeSize = int64(1 << 20)    // 1MB
+	const maxProbeSize = int64(2 << 30)    // 2GB
+	const probeResolution = int64(1 << 20) // 1MB
+
+	largeClient := client.Clone()
+	largeClient.ResponseHeaderTimeout = largeObjectTimeout
+
+	// isCached requests a new object of size bytes twice and reports
+	// whether the second request was served from cache.
+	isCached := func(size int64) bool {
+		var originRequests int64
+
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&originRequests, 1)
+
+			w.Header().Set("Cache-Control", "max-age=1800, public")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.Copy(w, newLargeObjectReader(0, size))
+		})
+
+		req := NewUniqueEdgeGET(t)
+		for requestCount := 1; requestCount < 3; requestCount++ {
+			resp, err := largeClient.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return atomic.LoadInt64(&originRequests) == 1
+	}
+
+	if !isCached(minProbeSize) {
+		t.Fatalf("Object of %d bytes was not cached", minProbeSize)
+	}
+	if isCached(maxProbeSize) {
+		t.Logf("Maximum cacheable object size is at least %d bytes", maxProbeSize)
+		return
+	}
+
+	lower, upper := minProbeSize, maxProbeSize
+	for upper-lower > probeResolution {
+		size := lower + (upper-lower)/2
+		if isCached(size) {
+			lower = size
+		} else {
+			upper = size
+		}
+	}
+
+	t.Logf(
+		"Maximum cacheable object size is between %d and %d bytes",
+		lower,
+		upper,
+	)
+}
+
+// Should evict the least recently requested objects once the cache is full,
+// without affecting the correctness of any responses. The cache is filled
+// with enough unique objects to exceed -cacheSize twice over, whilst one
+// object is requested in between each of them to keep it recently used.
+// That object should remain in cache and the first object should have been
+// evicted.
+func TestLargeObjectsEviction(t *testing.T) {
+	checkForLargeObjects(t)
+	if *cacheSize == 0 {
+		t.Skip("Eviction tests require -cacheSize")
+	}
+	ResetBackends(backendsByPriority)
+
+	const objectSize = int64(100 << 20) // 100MB
+	objectCount := int((*cacheSize<<20)*2/objectSize) + 1
+
+	largeClient := client.Clone()
+	largeClient.ResponseHeaderTimeout = largeObjectTimeout
+
+	// Each object's data is derived from its unique query string, so that
+	// origin doesn't need to keep track of the objects that it has served.
+	seedFor := func(u *url.URL) int64 {
+		hash := fnv.New64a()
+		hash.Write([]byte(u.RawQuery))
+		return int64(hash.Sum64())
+	}
+
+	var originRequests int64
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&originRequests, 1)
+
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Header().Set("Content-Length", strconv.FormatInt(objectSize, 10))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, newLargeObjectReader(seedFor(r.URL), objectSize))
+	})
+
+	// fetch makes a request, verifies the body, and reports whether it was
+	// served by origin rather than from cache.
+	fetch := func(req *http.Request) bool {
+		before := atomic.LoadInt64(&originRequests)
+
+		resp, err := largeClient.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		checksum, err := largeObjectChecksum(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedChecksum, err := largeObjectChecksum(newLargeObjectReader(seedFor(req.URL), objectSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(checksum, expectedChecksum) {
+			t.Errorf(
+				"Request for %s received incorrect body. Expected SHA-256 %x, got %x",
+				req.URL,
+				expectedChecksum,
+				checksum,
+			)
+		}
+
+		return atomic.LoadInt64(&originRequests) > before
+	}
+
+	recentReq := NewUniqueEdgeGET(t)
+	fetch(recentReq)
+
+	var firstReq *http.Request
+	for objectNum := 1; objectNum <= objectCount; objectNum++ {
+		req := NewUniqueEdgeGET(t)
+		if objectNum == 1 {
+			firstReq = req
+		}
+
+		fetch(req)
+
+		if fetch(recentReq) {
+			t.Errorf(
+				"Recently requested object was evicted after filling cache with %d objects",
+				objectNum,
+			)
+		}
+	}
+
+	if !fetch(firstReq) {
+		t.Errorf(
+			"Least recently requested object was not evicted after filling cache with %d bytes",
+			int64(objectCount)*objectSize,
+		)
+	}
+}
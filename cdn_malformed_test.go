@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// Tests in this file use WriteRawResponse() to have origin send responses
+// that are deliberately malformed, as a misbehaving application might.
+
+// newRawResponse returns a raw HTTP/1.1 200 response with a cacheable
+// `Cache-Control` header and the given `Content-Length` and body, which
+// don't need to agree.
+func newRawResponse(contentLength int, body string) []byte {
+	return []byte(fmt.Sprintf(
+		"HTTP/1.1 200 OK\r\n"+
+			"Cache-Control: max-age=1800, public\r\n"+
+			"Content-Length: %d\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"\r\n"+
+			"%s",
+		contentLength,
+		body,
+	))
+}
+
+// Should not serve as successful, or cache, a response from origin that is
+// shorter than its declared `Content-Length`, because it has been
+// truncated. The client should receive an error instead.
+func TestMalformedContentLengthTooLarge(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "the whole of the body"
+	truncatedBody := expectedBody[:len(expectedBody)/2]
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		raw := newRawResponse(len(expectedBody), truncatedBody)
+		if err := WriteRawResponse(w, raw); err != nil {
+			t.Error(err)
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusOK && err == nil {
+		t.Errorf(
+			"Truncated response served as successful. Got status %d and body %q",
+			resp.StatusCode,
+			body,
+		)
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request after truncated response received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
+
+// Should only serve the number of bytes declared by `Content-Length` from a
+// response that is longer, or an error, and not allow the excess bytes to
+// be interpreted as the response to a subsequent request.
+func TestMalformedContentLengthTooSmall(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const declaredBody = "declared body"
+	const excessBody = "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nsmuggled"
+	const expectedBody = "next response"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		raw := newRawResponse(len(declaredBody), declaredBody+excessBody)
+		if err := WriteRawResponse(w, raw); err != nil {
+			t.Error(err)
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if bodyStr := string(body); resp.StatusCode == http.StatusOK && err == nil && bodyStr != declaredBody {
+		t.Errorf(
+			"Over-long response served incorrectly. Expected %q, got %q",
+			declaredBody,
+			bodyStr,
+		)
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	req = NewUniqueEdgeGET(t)
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request after over-long response received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
@@ -58,9 +58,72 @@ func TestMiscProtocolRedirect(t *testing.T) {
 	}
 }
 
+// Should answer HTTP requests with a redirect to HTTPS from the edge, for a
+// variety of paths and query strings, however many times the same URL is
+// requested. Repeat requests must be served without going to origin, just
+// as a cached redirect would be.
+func TestMiscProtocolRedirectCacheable(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedStatus = http.StatusMovedPermanently
+	const requestsExpectedCount = 0
+	paths := []string{
+		"/",
+		"/one/two",
+		"/encoded path",
+	}
+
+	var originRequests RequestRecorder
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+	})
+
+	for _, path := range paths {
+		req := NewUniqueEdgeGET(t)
+		req.URL.Scheme = "http"
+		req.URL.Path = path
+		req.URL.RawQuery += "&a=1&b=two%20words"
+
+		expectedURL := *req.URL
+		expectedURL.Scheme = "https"
+
+		for requestCount := 1; requestCount < 3; requestCount++ {
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != expectedStatus {
+				t.Errorf(
+					"Request %d received incorrect status code for %q. Expected %d, got %d",
+					requestCount,
+					path,
+					expectedStatus,
+					resp.StatusCode,
+				)
+			}
+			if dest := resp.Header.Get("Location"); dest != expectedURL.String() {
+				t.Errorf(
+					"Request %d received incorrect Location header for %q. Expected %q, got %q",
+					requestCount,
+					path,
+					expectedURL.String(),
+					dest,
+				)
+			}
+		}
+	}
+
+	if count := originRequests.Count(); count != requestsExpectedCount {
+		t.Errorf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			requestsExpectedCount,
+			count,
+		)
+	}
+}
+
 // Should return 403 and not invalidate the edge's cache for PURGE requests
-// that come from IPs not in the whitelist. We assume that this is not
-// running from a whitelisted address.
+// that come from IPs not in the whitelist, with or without an incorrect
+// purge key. We assume that this is not running from a whitelisted address.
 func TestMiscRestrictPurgeRequests(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
@@ -68,7 +131,7 @@ func TestMiscRestrictPurgeRequests(t *testing.T) {
 	var expectedStatus int
 	req := NewUniqueEdgeGET(t)
 
-	for requestCount := 1; requestCount < 4; requestCount++ {
+	for requestCount := 1; requestCount < 5; requestCount++ {
 		switch requestCount {
 		case 1:
 			req.Method = "GET"
@@ -88,7 +151,13 @@ func TestMiscRestrictPurgeRequests(t *testing.T) {
 				w.Write([]byte(originServer.Name))
 			})
 		case 3:
+			req.Method = "PURGE"
+			req.Header.Set(*purgeKeyName, "not-"+NewUUID())
+			expectedBody = ""
+			expectedStatus = 403
+		case 4:
 			req.Method = "GET"
+			req.Header.Del(*purgeKeyName)
 			expectedBody = "this should not be purged"
 			expectedStatus = 200
 		}
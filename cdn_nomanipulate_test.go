@@ -1,6 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
 	"testing"
 )
 
@@ -50,3 +57,104 @@ func TestNoManipulationGIF(t *testing.T) {
 
 	testResponseNotManipulated(t, "fixtures/golang.gif")
 }
+
+// Should deliver responses with a `Cache-Control: no-transform` header
+// byte-identical to those sent by origin, both from origin and from cache.
+// The edge must not compress uncompressed bodies, or decompress or
+// recompress those that are already compressed, even though the client
+// advertises that it accepts other encodings:
+// http://tools.ietf.org/html/rfc7234#section-5.2.2.4
+func TestNoManipulationNoTransform(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	fixtureFiles := []string{
+		"fixtures/golang.html",
+		"fixtures/golang.png",
+	}
+
+	for _, fixtureFile := range fixtureFiles {
+		for _, contentEncoding := range []string{"", "gzip"} {
+			t.Logf("Testing %q with Content-Encoding %q", fixtureFile, contentEncoding)
+			testResponseNoTransform(t, fixtureFile, contentEncoding)
+		}
+	}
+}
+
+// testResponseNoTransform serves a fixture from origin, optionally gzipped
+// when contentEncoding is "gzip", with a `Cache-Control: no-transform`
+// header. It then requests it twice and compares checksums of the bodies,
+// and the `Content-Encoding` and `Content-Type` headers, with those sent by
+// origin.
+func testResponseNoTransform(t *testing.T, fixtureFile string, contentEncoding string) {
+	fixtureData, err := ioutil.ReadFile(fixtureFile)
+	if err != nil {
+		t.Fatalf("Unable load fixture file %q", fixtureFile)
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(fixtureFile))
+	originData := fixtureData
+
+	if contentEncoding == "gzip" {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(fixtureData); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		originData = buf.Bytes()
+	}
+
+	expectedChecksum := sha256.Sum256(originData)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1800, public, no-transform")
+		w.Header().Set("Content-Type", contentType)
+		if contentEncoding != "" {
+			w.Header().Set("Content-Encoding", contentEncoding)
+		}
+		w.Write(originData)
+	})
+
+	req := NewUniqueEdgeGET(t)
+	req.URL.Path = "/" + filepath.Base(fixtureFile)
+	// Setting this ourselves prevents the transport from transparently
+	// decompressing the body.
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if checksum := sha256.Sum256(body); checksum != expectedChecksum {
+			t.Errorf(
+				"Request %d received incorrect body. Expected SHA-256 %x, got %x",
+				requestCount,
+				expectedChecksum,
+				checksum,
+			)
+		}
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != contentEncoding {
+			t.Errorf(
+				"Request %d received incorrect Content-Encoding. Expected %q, got %q",
+				requestCount,
+				contentEncoding,
+				encoding,
+			)
+		}
+		if receivedType := resp.Header.Get("Content-Type"); receivedType != contentType {
+			t.Errorf(
+				"Request %d received incorrect Content-Type. Expected %q, got %q",
+				requestCount,
+				contentType,
+				receivedType,
+			)
+		}
+	}
+}
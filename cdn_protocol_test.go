@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"testing"
+)
+
+// Tests in this file check compatibility with older or less common parts
+// of HTTP that net/http hides or doesn't send, so many of them write raw
+// requests to a TLS connection.
+
+// Should respond correctly to HTTP/1.0 requests, with and without a `Host`
+// header, as sent by legacy clients and monitoring tools. Origin sends a
+// chunked response, which the edge mustn't pass on because HTTP/1.0
+// clients don't understand it, and the edge should close the connection
+// afterwards because the client didn't ask for keep-alive. Without a Host
+// the edge may respond with a 4xx, but never a 5xx.
+func TestProtocolHTTP10(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "partying like it's 1996"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private")
+		w.Write([]byte(expectedBody[:5]))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(expectedBody[5:]))
+	})
+
+	hostHeaders := []struct {
+		Name string
+		Raw  string
+	}{
+		{"with Host", "Host: " + *edgeHost + "\r\n"},
+		{"without Host", ""},
+	}
+
+	for _, hostHeader := range hostHeaders {
+		config := newEdgeTLSConfig()
+		config.NextProtos = []string{"http/1.1"}
+
+		conn, err := dialEdgeTLS(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		raw := "GET /?nocache=" + NewUUID() + " HTTP/1.0\r\n" +
+			hostHeader.Raw +
+			"\r\n"
+		if _, err := conn.Write([]byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Unable to read response to HTTP/1.0 request %s: %s", hostHeader.Name, err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hostHeader.Raw == "" && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			t.Logf("Edge rejected HTTP/1.0 request without Host with status %d", resp.StatusCode)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(
+				"Received incorrect status code for HTTP/1.0 request %s. Expected %d, got %d",
+				hostHeader.Name,
+				http.StatusOK,
+				resp.StatusCode,
+			)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Received incorrect response body for HTTP/1.0 request %s. Expected %q, got %q",
+				hostHeader.Name,
+				expectedBody,
+				bodyStr,
+			)
+		}
+		if len(resp.TransferEncoding) > 0 {
+			t.Errorf(
+				"Response to HTTP/1.0 request %s used Transfer-Encoding %q",
+				hostHeader.Name,
+				resp.TransferEncoding,
+			)
+		}
+
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("Edge didn't close connection after HTTP/1.0 request %s: %v", hostHeader.Name, err)
+		}
+	}
+}
+
+// Should relay the interim `100 Continue` response, whether from origin or
+// the edge itself, to a client that sends `Expect: 100-continue` with a
+// large request body, and then pass the whole body to origin intact.
+func TestProtocolExpectContinue(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const bodySize = 1024 * 1024
+	var receivedBody []byte
+
+	sentBody := make([]byte, bodySize)
+	rand.Read(sentBody)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		receivedBody, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Wait for the 100 before sending the body, instead of immediately.
+	continueClient := client.Clone()
+	continueClient.ExpectContinueTimeout = requestTimeout
+
+	var got100Continue bool
+	trace := &httptrace.ClientTrace{
+		Got100Continue: func() {
+			got100Continue = true
+		},
+	}
+
+	req := NewUniqueEdgeGET(t)
+	req.Method = "POST"
+	req.Body = ioutil.NopCloser(bytes.NewReader(sentBody))
+	req.ContentLength = bodySize
+	req.Header.Set("Expect", "100-continue")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := continueClient.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf(
+			"Received incorrect status code. Expected %d, got %d",
+			http.StatusOK,
+			resp.StatusCode,
+		)
+	}
+	if !got100Continue {
+		t.Error("Client didn't receive a 100 Continue response")
+	}
+	if !bytes.Equal(receivedBody, sentBody) {
+		t.Errorf(
+			"Origin received incorrect request body. Expected %d bytes, got %d bytes that differ",
+			len(sentBody),
+			len(receivedBody),
+		)
+	}
+}
+
+// Should pass the body of a chunked response with trailers intact, and
+// pass the trailers on only if -trailers is set. Vendors generally drop
+// trailers, other than for gRPC, so this documents that in case it changes.
+func TestProtocolTrailers(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "the tail wags the dog"
+	const trailerName = "X-Checksum"
+	trailerVal := NewUUID()
+	expectedTrailers := *trailers
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private")
+		w.Header().Set("Trailer", trailerName)
+		w.Write([]byte(expectedBody))
+		w.Header().Set(trailerName, trailerVal)
+	})
+
+	resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+
+	receivedTrailers := resp.Trailer.Get(trailerName) == trailerVal
+	switch {
+	case expectedTrailers && !receivedTrailers:
+		t.Errorf("Edge dropped %q trailer and shouldn't have", trailerName)
+	case !expectedTrailers && receivedTrailers:
+		t.Errorf("Edge passed %q trailer and didn't used to; update the expectation", trailerName)
+	}
+}
+
+// Should reuse connections to origin for sequential requests from a client
+// that reuses its own connection, rather than opening one per request.
+// Origin counts requests per connection, by remote address, and the
+// client confirms that it reused its connection to the edge.
+func TestProtocolKeepAliveConnectionReuse(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const requestCount = 10
+
+	var mutex sync.Mutex
+	originConns := map[string]int{}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		originConns[r.RemoteAddr]++
+		mutex.Unlock()
+
+		w.Header().Set("Cache-Control", "private")
+	})
+
+	var clientReused int
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				clientReused++
+			}
+		},
+	}
+
+	for i := 0; i < requestCount; i++ {
+		req := NewUniqueEdgeGET(t)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+		resp := RoundTripCheckError(t, req)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	if expected := requestCount - 1; clientReused < expected {
+		t.Fatalf(
+			"Client didn't reuse its connection to edge. Expected %d reused, got %d",
+			expected,
+			clientReused,
+		)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	t.Logf("Origin received %d requests over %d connections: %v", requestCount, len(originConns), originConns)
+	if len(originConns) >= requestCount {
+		t.Errorf(
+			"Edge didn't reuse connections to origin. Expected fewer than %d, got %d",
+			requestCount,
+			len(originConns),
+		)
+	}
+}
+
+// Should either forward or strip a `103 Early Hints` interim response from
+// origin, but do so consistently, and cache the final response as normal.
+// Two URLs are requested, so that both are misses, and then the first is
+// requested again, which should be a hit.
+func TestProtocolEarlyHints(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const linkHeader = "</style.css>; rel=preload; as=style"
+	var originRequests RequestRecorder
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+
+		w.Header().Set("Link", linkHeader)
+		w.WriteHeader(http.StatusEarlyHints)
+
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Write([]byte(NewUUID()))
+	})
+
+	var hints []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints[len(hints)-1]++
+				if link := header.Get("Link"); link != linkHeader {
+					t.Errorf(
+						"Received incorrect Link header in 103. Expected %q, got %q",
+						linkHeader,
+						link,
+					)
+				}
+			}
+			return nil
+		},
+	}
+
+	urls := []string{NewUniqueEdgeURL(), NewUniqueEdgeURL()}
+	urls = append(urls, urls[0])
+	var bodies []string
+
+	for _, url := range urls {
+		hints = append(hints, 0)
+
+		req := NewEdgeRequest(t, "GET", url)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+		resp := RoundTripCheckError(t, req)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(
+				"Received incorrect status code. Expected %d, got %d",
+				http.StatusOK,
+				resp.StatusCode,
+			)
+		}
+		bodies = append(bodies, string(body))
+	}
+
+	t.Logf("Received 103 responses for misses: %d and %d", hints[0], hints[1])
+	if hints[0] != hints[1] {
+		t.Error("Edge forwarded 103 Early Hints inconsistently")
+	}
+
+	if count := originRequests.Count(); count != 2 {
+		t.Errorf("Origin received the wrong number of requests. Expected 2, got %d", count)
+	}
+	if bodies[2] != bodies[0] {
+		t.Errorf(
+			"Response after 103 wasn't cached. Expected %q, got %q",
+			bodies[0],
+			bodies[2],
+		)
+	}
+}
+
+// Should handle requests with an absolute-URI request-target, as sent to
+// proxies, as if they were for the same path, or reject them cleanly with
+// a 4xx. The path is first requested normally so that it's cached, and any
+// absolute-URI requests that are handled should be served from that cache
+// entry, rather than creating duplicates.
+func TestProtocolAbsoluteURI(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	var originRequests RequestRecorder
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Write([]byte(NewUUID()))
+	})
+
+	path := "/?nocache=" + NewUUID()
+
+	resp, err := roundTripRaw(newRawRequest("GET", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedBody, _ := ioutil.ReadAll(resp.Body)
+
+	for _, scheme := range []string{"http", "https"} {
+		target := scheme + "://" + *edgeHost + path
+
+		resp, err := roundTripRaw(newRawRequest("GET", target))
+		if err != nil {
+			t.Errorf("Edge closed connection for %s: %s", target, err)
+			continue
+		}
+
+		switch {
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			t.Logf("Edge rejected %s with status %d", target, resp.StatusCode)
+		case resp.StatusCode != http.StatusOK:
+			t.Errorf(
+				"Received incorrect status code for %s. Expected %d or 4xx, got %d",
+				target,
+				http.StatusOK,
+				resp.StatusCode,
+			)
+		default:
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != string(expectedBody) {
+				t.Errorf(
+					"Request for %s wasn't served from the same cache entry. Expected %q, got %q",
+					target,
+					expectedBody,
+					body,
+				)
+			}
+		}
+	}
+
+	if count := originRequests.Count(); count != 1 {
+		t.Errorf("Origin received the wrong number of requests. Expected 1, got %d", count)
+	}
+}
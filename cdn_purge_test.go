@@ -0,0 +1,292 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// checkForPurgeKey skips the calling test if the purgeKey flag hasn't been
+// set, because we can't authenticate PURGE requests without it.
+func checkForPurgeKey(t *testing.T) {
+	if *purgeKey == "" {
+		t.Skip("Purge tests require -purgeKey")
+	}
+}
+
+// Should remove a single URL from cache when sent an authenticated PURGE
+// request for it, so that the next request goes back to origin.
+func TestPurgeSingleURL(t *testing.T) {
+	checkForPurgeKey(t)
+	ResetBackends(backendsByPriority)
+
+	const expectedResponseCached = "this should be purged"
+	const expectedResponsePurged = "fetched again after purge"
+	const expectedPurgeStatus = http.StatusOK
+
+	url := NewUniqueEdgeURL()
+	req := NewEdgeRequest(t, "GET", url)
+
+	var expectedBody string
+	for requestCount := 1; requestCount < 4; requestCount++ {
+		switch requestCount {
+		case 1: // Request 1 populates cache.
+			expectedBody = expectedResponseCached
+
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(expectedBody))
+			})
+		case 2: // Request 2 comes from cache.
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("Request %d should not have made it to origin", requestCount)
+				w.Write([]byte(originServer.Name))
+			})
+		case 3: // Request 3 comes from origin after the purge.
+			purgeResp := RoundTripCheckError(t, NewEdgePURGE(t, url))
+			defer purgeResp.Body.Close()
+
+			if purgeResp.StatusCode != expectedPurgeStatus {
+				t.Fatalf(
+					"PURGE request received incorrect status code. Expected %d, got %d",
+					expectedPurgeStatus,
+					purgeResp.StatusCode,
+				)
+			}
+
+			expectedBody = expectedResponsePurged
+
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(expectedBody))
+			})
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should remove every object tagged with a `Surrogate-Key` from cache when
+// that key is purged, but leave objects that weren't tagged with it.
+func TestPurgeSurrogateKey(t *testing.T) {
+	checkForPurgeKey(t)
+	ResetBackends(backendsByPriority)
+
+	if vendorCloudflare {
+		t.Skip(notSupportedByVendor)
+	}
+	if *surrogateKeyPurgeURL == "" {
+		t.Skip("Surrogate-Key purge test requires -surrogateKeyPurgeURL")
+	}
+
+	const expectedPurgeStatus = http.StatusOK
+	const respHeaderName = "Response-ID"
+	purgedKey := NewUUID()
+	untouchedKey := NewUUID()
+
+	// Objects tagged with more than one key should still be purged.
+	keysByPath := map[string]string{
+		"/tagged-one": purgedKey,
+		"/tagged-two": untouchedKey + " " + purgedKey,
+		"/untouched":  untouchedKey,
+		"/untagged":   "",
+	}
+	responseIDs := map[string]string{}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		if key := keysByPath[r.URL.Path]; key != "" {
+			w.Header().Set("Surrogate-Key", key)
+		}
+		w.Header().Set(respHeaderName, NewUUID())
+	})
+
+	baseReq := NewUniqueEdgeGET(t)
+	reqsByPath := map[string]*http.Request{}
+	for path := range keysByPath {
+		req := NewEdgeRequest(t, "GET", baseReq.URL.String())
+		req.URL.Path = path
+		reqsByPath[path] = req
+	}
+
+	for _, purged := range []bool{false, true} {
+		if purged {
+			purgeResp := RoundTripCheckError(t, NewSurrogateKeyPurge(t, purgedKey))
+			defer purgeResp.Body.Close()
+
+			if purgeResp.StatusCode != expectedPurgeStatus {
+				t.Fatalf(
+					"Surrogate-Key purge received incorrect status code. Expected %d, got %d",
+					expectedPurgeStatus,
+					purgeResp.StatusCode,
+				)
+			}
+		}
+
+		for path, req := range reqsByPath {
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			recVal := resp.Header.Get(respHeaderName)
+			if !purged {
+				responseIDs[path] = recVal
+				continue
+			}
+
+			shouldBePurged := strings.Contains(keysByPath[path], purgedKey)
+			if wasPurged := recVal != responseIDs[path]; wasPurged != shouldBePurged {
+				t.Errorf(
+					"Request for %q after purge was incorrect. Expected purged to be %t, got %t",
+					path,
+					shouldBePurged,
+					wasPurged,
+				)
+			}
+		}
+	}
+}
+
+// Should mark an object as stale when sent an authenticated soft PURGE
+// request for it, so that the next request is revalidated with origin.
+func TestPurgeSoftRevalidates(t *testing.T) {
+	checkForPurgeKey(t)
+	ResetBackends(backendsByPriority)
+
+	if vendorCloudflare {
+		t.Skip(notSupportedByVendor)
+	}
+
+	const expectedResponseStale = "going off like stilton"
+	const expectedResponseFresh = "as fresh as daisies"
+	const expectedPurgeStatus = http.StatusOK
+	var originRequests RequestRecorder
+
+	url := NewUniqueEdgeURL()
+	req := NewEdgeRequest(t, "GET", url)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+		w.Header().Set("Cache-Control", "max-age=1800")
+
+		if originRequests.Count() == 1 {
+			w.Write([]byte(expectedResponseStale))
+		} else {
+			w.Write([]byte(expectedResponseFresh))
+		}
+	})
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	purgeResp := RoundTripCheckError(t, NewEdgeSoftPURGE(t, url))
+	defer purgeResp.Body.Close()
+
+	if purgeResp.StatusCode != expectedPurgeStatus {
+		t.Fatalf(
+			"Soft PURGE request received incorrect status code. Expected %d, got %d",
+			expectedPurgeStatus,
+			purgeResp.StatusCode,
+		)
+	}
+
+	// The first request after the purge may be served stale whilst it is
+	// revalidated, but subsequent requests must be fresh.
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bodyStr := string(body)
+		if requestCount == 1 && bodyStr == expectedResponseStale {
+			continue
+		}
+		if bodyStr != expectedResponseFresh {
+			t.Errorf(
+				"Request %d after purge received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedResponseFresh,
+				bodyStr,
+			)
+		}
+	}
+
+	const expectedOriginRequests = 2
+	if count := originRequests.Count(); count != expectedOriginRequests {
+		t.Errorf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			expectedOriginRequests,
+			count,
+		)
+	}
+}
+
+// Should continue to serve an object that has been soft purged from stale
+// if all backends are down, because it remains available for grace.
+func TestPurgeSoftServeStaleBackendsDown(t *testing.T) {
+	checkForPurgeKey(t)
+	ResetBackends(backendsByPriority)
+
+	if vendorCloudflare {
+		t.Skip(notSupportedByVendor)
+	}
+
+	const expectedBody = "going off like stilton"
+	const expectedPurgeStatus = http.StatusOK
+
+	url := NewUniqueEdgeURL()
+	req := NewEdgeRequest(t, "GET", url)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1800, stale-if-error=86400")
+		w.Write([]byte(expectedBody))
+	})
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	purgeResp := RoundTripCheckError(t, NewEdgeSoftPURGE(t, url))
+	defer purgeResp.Body.Close()
+
+	if purgeResp.StatusCode != expectedPurgeStatus {
+		t.Fatalf(
+			"Soft PURGE request received incorrect status code. Expected %d, got %d",
+			expectedPurgeStatus,
+			purgeResp.StatusCode,
+		)
+	}
+
+	stopBackends(backendsByPriority)
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request after soft purge received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
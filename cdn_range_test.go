@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rangeContent is served by origin for range requests. It's long enough
+// that ranges from different parts of it are easily distinguished.
+var rangeContent = []byte(strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 100))
+
+// serveRangeContent serves rangeContent with http.ServeContent, which
+// handles range requests in the same way as a typical origin would.
+func serveRangeContent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=1800, public")
+	http.ServeContent(w, r, "range.txt", time.Unix(0, 0), bytes.NewReader(rangeContent))
+}
+
+// checkRangeResponse asserts that resp is a 206 response for the bytes of
+// rangeContent from first to last inclusive, with the correct
+// `Content-Range` header and body.
+func checkRangeResponse(t *testing.T, resp *http.Response, first int, last int) {
+	const expectedStatus = http.StatusPartialContent
+	expectedContentRange := fmt.Sprintf("bytes %d-%d/%d", first, last, len(rangeContent))
+	expectedBody := rangeContent[first : last+1]
+
+	if resp.StatusCode != expectedStatus {
+		t.Errorf(
+			"Range request received incorrect status code. Expected %d, got %d",
+			expectedStatus,
+			resp.StatusCode,
+		)
+	}
+
+	if val := resp.Header.Get("Content-Range"); val != expectedContentRange {
+		t.Errorf(
+			"Range request received incorrect Content-Range header. Expected %q, got %q",
+			expectedContentRange,
+			val,
+		)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(body, expectedBody) {
+		t.Errorf(
+			"Range request received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			body,
+		)
+	}
+}
+
+// checkWholeObjectResponse makes a request without a `Range` header and
+// asserts that it receives all of rangeContent. This is used to confirm that
+// the cache hasn't been poisoned by a previous range request.
+func checkWholeObjectResponse(t *testing.T, req *http.Request) {
+	req.Header.Del("Range")
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf(
+			"Request for whole object received incorrect status code. Expected %d, got %d",
+			http.StatusOK,
+			resp.StatusCode,
+		)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(body, rangeContent) {
+		t.Errorf(
+			"Request for whole object received incorrect response body. Expected %d bytes, got %d",
+			len(rangeContent),
+			len(body),
+		)
+	}
+}
+
+// Should satisfy a `Range` request for an object that is already in cache
+// with a 206 response from the edge, without contacting origin.
+func TestRangeFromCache(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const first, last = 100, 199
+
+	originServer.SwitchHandler(serveRangeContent)
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Request should not have made it to origin")
+		w.Write([]byte("not cached"))
+	})
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	checkRangeResponse(t, resp, first, last)
+}
+
+// Should satisfy a `Range` request for an object that isn't in cache with
+// the correct 206 response. The edge may fetch and cache the whole object,
+// or pass the range through to origin, but subsequent requests for the
+// whole object must receive all of it, uncorrupted.
+func TestRangeColdCache(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const first, last = 100, 199
+
+	originServer.SwitchHandler(serveRangeContent)
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	checkRangeResponse(t, resp, first, last)
+	checkWholeObjectResponse(t, req)
+}
+
+// Should satisfy a `Range` request for multiple ranges with a 206
+// `multipart/byteranges` response containing each range. Servers are
+// permitted to ignore ranges, so a 200 response with the whole object is
+// also acceptable. Either way the cache must not be poisoned.
+func TestRangeMultipart(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	ranges := [][2]int{{0, 9}, {200, 299}}
+
+	originServer.SwitchHandler(serveRangeContent)
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("Range", fmt.Sprintf(
+		"bytes=%d-%d,%d-%d",
+		ranges[0][0], ranges[0][1],
+		ranges[1][0], ranges[1][1],
+	))
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, rangeContent) {
+			t.Errorf(
+				"Multi-range request ignored but received incorrect response body. Expected %d bytes, got %d",
+				len(rangeContent),
+				len(body),
+			)
+		}
+	case http.StatusPartialContent:
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/byteranges" {
+			t.Fatalf(
+				"Multi-range request received incorrect Content-Type. Expected %q, got %q",
+				"multipart/byteranges",
+				resp.Header.Get("Content-Type"),
+			)
+		}
+
+		reader := multipart.NewReader(resp.Body, params["boundary"])
+		for _, byteRange := range ranges {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedContentRange := fmt.Sprintf("bytes %d-%d/%d", byteRange[0], byteRange[1], len(rangeContent))
+			if val := part.Header.Get("Content-Range"); val != expectedContentRange {
+				t.Errorf(
+					"Multi-range part received incorrect Content-Range header. Expected %q, got %q",
+					expectedContentRange,
+					val,
+				)
+			}
+
+			body, err := ioutil.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expectedBody := rangeContent[byteRange[0] : byteRange[1]+1]; !bytes.Equal(body, expectedBody) {
+				t.Errorf(
+					"Multi-range part received incorrect body. Expected %q, got %q",
+					expectedBody,
+					body,
+				)
+			}
+		}
+
+		if _, err := reader.NextPart(); err != io.EOF {
+			t.Errorf("Multi-range request received more parts than expected: %v", err)
+		}
+	default:
+		t.Errorf(
+			"Multi-range request received incorrect status code. Expected %d or %d, got %d",
+			http.StatusOK,
+			http.StatusPartialContent,
+			resp.StatusCode,
+		)
+	}
+
+	checkWholeObjectResponse(t, req)
+}
+
+// Should respond to a `Range` request that starts beyond the end of the
+// object with a 416 response and a `Content-Range` header giving the
+// object's length, without poisoning the cache:
+// http://tools.ietf.org/html/rfc7233#section-4.4
+func TestRangeUnsatisfiable(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedStatus = http.StatusRequestedRangeNotSatisfiable
+	expectedContentRange := fmt.Sprintf("bytes */%d", len(rangeContent))
+
+	originServer.SwitchHandler(serveRangeContent)
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(rangeContent)*2))
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Errorf(
+			"Unsatisfiable range request received incorrect status code. Expected %d, got %d",
+			expectedStatus,
+			resp.StatusCode,
+		)
+	}
+	if val := resp.Header.Get("Content-Range"); val != expectedContentRange {
+		t.Errorf(
+			"Unsatisfiable range request received incorrect Content-Range header. Expected %q, got %q",
+			expectedContentRange,
+			val,
+		)
+	}
+
+	checkWholeObjectResponse(t, req)
+}
+
+// Should respond to a syntactically invalid `Range` header by ignoring it
+// and returning the whole object, or by rejecting it with a 416 response,
+// as origin does. Either way the cache must not be poisoned.
+func TestRangeInvalid(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	headerVals := []string{
+		"bytes=abc",
+		"bytes=10-5",
+		"chars=0-9",
+		"bytes=--1",
+	}
+
+	originServer.SwitchHandler(serveRangeContent)
+
+	for _, headerVal := range headerVals {
+		req := NewUniqueEdgeGET(t)
+		req.Header.Set("Range", headerVal)
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(body, rangeContent) {
+				t.Errorf(
+					"Request with invalid Range %q received incorrect response body. Expected %d bytes, got %d",
+					headerVal,
+					len(rangeContent),
+					len(body),
+				)
+			}
+		case http.StatusRequestedRangeNotSatisfiable:
+		default:
+			t.Errorf(
+				"Request with invalid Range %q received incorrect status code. Expected %d or %d, got %d",
+				headerVal,
+				http.StatusOK,
+				http.StatusRequestedRangeNotSatisfiable,
+				resp.StatusCode,
+			)
+		}
+
+		checkWholeObjectResponse(t, req)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
@@ -8,13 +9,15 @@ import (
 )
 
 // Should set an `X-Forwarded-For` header for requests that don't already
-// have one and append to requests that already have the header. This test
-// will not work if run from behind a proxy that also sets XFF.
+// have one and append to requests that already have the header. The IP
+// should be -egressIP, if set. This test will not work if run from behind
+// a proxy that also sets XFF.
 func TestReqHeaderXFFCreateAndAppend(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
 	const headerName = "X-Forwarded-For"
 	const sentHeaderVal = "203.0.113.99"
+	expectedIP := egressPublicIP(t)
 	var ourReportedIP net.IP
 	var receivedHeaderVal string
 
@@ -39,6 +42,14 @@ func TestReqHeaderXFFCreateAndAppend(t *testing.T) {
 			receivedHeaderVal,
 		)
 	}
+	if expectedIP != nil && !ourReportedIP.Equal(expectedIP) {
+		t.Errorf(
+			"Origin received %q header without egress IP. Expected %q, got %q",
+			headerName,
+			expectedIP,
+			ourReportedIP,
+		)
+	}
 
 	// Use the IP returned by the first response to predict the second.
 	expectedHeaderVals := []string{sentHeaderVal, ourReportedIP.String()}
@@ -76,13 +87,15 @@ func TestReqHeaderXFFCreateAndAppend(t *testing.T) {
 }
 
 // Should create a True-Client-IP header containing the client's IP
-// address, discarding the value provided in the original request. The name
-// of this header must be consistent across all vendors.
+// address, which should be -egressIP if set, discarding the value provided
+// in the original request. The name of this header must be consistent
+// across all vendors.
 func TestReqHeaderUnspoofableClientIP(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
 	const sentHeaderVal = "203.0.113.99"
 	const headerName = "True-Client-IP"
+	expectedIP := egressPublicIP(t)
 	var receivedHeaderVal string
 
 	sentHeaderIP := net.ParseIP(sentHeaderVal)
@@ -104,6 +117,14 @@ func TestReqHeaderUnspoofableClientIP(t *testing.T) {
 	if receivedHeaderIP.Equal(sentHeaderIP) {
 		t.Errorf("Origin received %q header with unmodified value %q", headerName, receivedHeaderIP)
 	}
+	if expectedIP != nil && !receivedHeaderIP.Equal(expectedIP) {
+		t.Errorf(
+			"Origin received %q header without egress IP. Expected %q, got %q",
+			headerName,
+			expectedIP,
+			receivedHeaderIP,
+		)
+	}
 }
 
 // Should not modify `Host` header from original request.
@@ -140,3 +161,171 @@ func TestReqHeaderHostUnmodified(t *testing.T) {
 		)
 	}
 }
+
+// Should send the header named by -originSecretName, with the value of
+// -originSecret, to each tier of backends as the preceding tiers go down,
+// so that backends can refuse requests that didn't come through the edge.
+func TestReqHeaderOriginSecret(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if *originSecret == "" {
+		t.Skip("Shared secret tests require -originSecret")
+	}
+
+	expectedHeaders := map[string]string{
+		*originSecretName: *originSecret,
+	}
+
+	checkEachBackendTier(t, func(index int, backend *CDNBackendServer, r *http.Request) {
+		checkRequestHeaders(t, backend.Name, r.Header, expectedHeaders)
+	})
+}
+
+// Should overwrite the header named by -originSecretName if the client
+// sends it, so that clients can't spoof a secret that they've guessed or
+// that has since been rotated.
+func TestReqHeaderOriginSecretUnspoofable(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if *originSecret == "" {
+		t.Skip("Shared secret tests require -originSecret")
+	}
+
+	const sentHeaderVal = "spoofed-origin-secret"
+	var receivedHeaderVals []string
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaderVals = r.Header[http.CanonicalHeaderKey(*originSecretName)]
+	})
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set(*originSecretName, sentHeaderVal)
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if len(receivedHeaderVals) != 1 || receivedHeaderVals[0] != *originSecret {
+		t.Errorf(
+			"Origin received %q header with wrong values. Expected [%q], got %q",
+			*originSecretName,
+			*originSecret,
+			receivedHeaderVals,
+		)
+	}
+}
+
+// parseForwarded parses the value of a `Forwarded` header (RFC 7239) into
+// its comma-separated elements, each of which is a map of lowercased
+// parameter names to values, with any quotes removed. An error is returned
+// if the value isn't well-formed.
+func parseForwarded(val string) ([]map[string]string, error) {
+	var elements []map[string]string
+
+	for _, elementStr := range strings.Split(val, ",") {
+		element := map[string]string{}
+
+		for _, pair := range strings.Split(elementStr, ";") {
+			parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("malformed parameter %q", pair)
+			}
+
+			value := parts[1]
+			if strings.HasPrefix(value, `"`) {
+				if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+					return nil, fmt.Errorf("unterminated quoted value %q", value)
+				}
+				value = value[1 : len(value)-1]
+			}
+
+			element[strings.ToLower(parts[0])] = value
+		}
+
+		elements = append(elements, element)
+	}
+
+	return elements, nil
+}
+
+// checkForwardedProto asserts that origin received a request that it can
+// tell was made over HTTPS, from an `X-Forwarded-Proto` header, a
+// well-formed `Forwarded` header whose last element is from the edge, or
+// both. The spoofed value is one sent by the client that must have been
+// overwritten, if not empty.
+func checkForwardedProto(t *testing.T, received http.Header, spoofed string) {
+	const expectedProto = "https"
+
+	xfp := received.Get("X-Forwarded-Proto")
+	forwarded := strings.Join(received["Forwarded"], ", ")
+
+	if xfp == "" && forwarded == "" {
+		t.Fatal("Origin received neither X-Forwarded-Proto nor Forwarded header")
+	}
+
+	if xfp != "" && xfp != expectedProto {
+		t.Errorf(
+			"Origin received incorrect X-Forwarded-Proto header. Expected %q, got %q",
+			expectedProto,
+			xfp,
+		)
+	}
+
+	if forwarded == "" {
+		return
+	}
+
+	elements, err := parseForwarded(forwarded)
+	if err != nil {
+		t.Fatalf("Origin received malformed Forwarded header %q: %s", forwarded, err)
+	}
+
+	if proto := elements[len(elements)-1]["proto"]; proto != expectedProto {
+		t.Errorf(
+			"Origin received Forwarded header with incorrect proto from edge. Expected %q, got %q",
+			expectedProto,
+			proto,
+		)
+	}
+	if spoofed != "" && strings.Contains(forwarded, spoofed) {
+		t.Errorf("Origin received Forwarded header with spoofed value %q: %q", spoofed, forwarded)
+	}
+}
+
+// Should tell origin that requests were made over HTTPS, with an
+// `X-Forwarded-Proto` header, a `Forwarded` header or both.
+func TestReqHeaderForwardedProto(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	var receivedHeaders http.Header
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header
+	})
+
+	resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+
+	checkForwardedProto(t, receivedHeaders, "")
+}
+
+// Should overwrite `X-Forwarded-Proto` and `Forwarded` headers sent by the
+// client, which could otherwise persuade origin that a request was made
+// over HTTP.
+func TestReqHeaderForwardedProtoUnspoofable(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const spoofedForwarded = "for=203.0.113.99;proto=http"
+
+	var receivedHeaders http.Header
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header
+	})
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("X-Forwarded-Proto", "http")
+	req.Header.Set("Forwarded", spoofedForwarded)
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	checkForwardedProto(t, receivedHeaders, spoofedForwarded)
+}
@@ -110,6 +110,57 @@ func TestRespHeaderAgeFromOrigin(t *testing.T) {
 	}
 }
 
+// Should set an Age header that increases monotonically and stays within
+// -ageTolerance of the wall-clock time since the object was cached.
+func TestRespHeaderAgeAccuracy(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "Age"
+	const timeBetweenRequests = time.Duration(3 * time.Second)
+	const requestsCount = 4
+	var cachedAt time.Time
+	var previousAge time.Duration
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		cachedAt = time.Now()
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Write([]byte("cacheable request"))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount <= requestsCount; requestCount++ {
+		if requestCount > 1 {
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Origin received request and it shouldn't have")
+			})
+
+			time.Sleep(timeBetweenRequests)
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Request %d received incorrect status %q", requestCount, resp.Status)
+		}
+
+		expectedAge := time.Since(cachedAt)
+		age := checkHeaderSecondsWithin(t, resp, headerName, expectedAge, *ageTolerance)
+
+		if age < previousAge {
+			t.Errorf(
+				"Request %d received %q header lower than previous. Expected >= %s, got %s",
+				requestCount,
+				headerName,
+				previousAge,
+				age,
+			)
+		}
+		previousAge = age
+	}
+}
+
 // Should set an X-Cache header containing HIT/MISS from 'origin, itself'
 func TestRespHeaderXCacheAppend(t *testing.T) {
 	ResetBackends(backendsByPriority)
@@ -150,20 +201,6 @@ func TestRespHeaderXCacheAppend(t *testing.T) {
 func TestRespHeaderCacheHitMiss(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
-	var (
-		headerName  string
-		headerValue string
-	)
-
-	switch {
-	case vendorCloudflare:
-		headerName = "CF-Cache-Status"
-	case vendorFastly:
-		headerName = "X-Cache"
-	default:
-		t.Fatal(notImplementedForVendor)
-	}
-
 	expectedHeaderValues := []string{"MISS", "HIT"}
 	const cacheDuration = time.Second
 
@@ -172,35 +209,74 @@ func TestRespHeaderCacheHitMiss(t *testing.T) {
 		expectedHeaderValues = append(expectedHeaderValues, cloudFlareStatuses...)
 	}
 
+	var originRequests RequestRecorder
 	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
 		cacheControlValue := fmt.Sprintf("max-age=%.0f", cacheDuration.Seconds())
 		w.Header().Set("Cache-Control", cacheControlValue)
 	})
 
 	req := NewUniqueEdgeGET(t)
+	requestsExpectedCount := 0
 
-	for count, expectedValue := range expectedHeaderValues {
+	for _, expectedValue := range expectedHeaderValues {
 
 		if expectedValue == "EXPIRED" {
 			// sleep long enough for object to have expired
 			sleepDuration := cacheDuration + time.Second
 			time.Sleep(sleepDuration)
 		}
+		if expectedValue != "HIT" {
+			requestsExpectedCount++
+		}
 
 		resp := RoundTripCheckError(t, req)
 		defer resp.Body.Close()
 
-		headerValue = resp.Header.Get(headerName)
+		checkCacheStatus(t, resp, expectedValue)
+	}
 
-		if headerValue != expectedValue {
-			t.Errorf(
-				"%s on request %d is wrong: expected %q, got %q",
-				headerName,
-				count+1,
-				expectedValue,
-				headerValue,
-			)
-		}
+	if count := originRequests.Count(); count != requestsExpectedCount {
+		t.Errorf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			requestsExpectedCount,
+			count,
+		)
+	}
+}
+
+// Should never report a HIT for responses that can't be cached.
+func TestRespHeaderCacheStatusNotCached(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const requestsExpectedCount = 3
+	var originRequests RequestRecorder
+
+	expectedStatus := "MISS"
+	if vendorCloudflare {
+		expectedStatus = "BYPASS"
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+		w.Header().Set("Cache-Control", "private")
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 4; requestCount++ {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		checkCacheStatus(t, resp, expectedStatus)
+	}
+
+	if count := originRequests.Count(); count != requestsExpectedCount {
+		t.Errorf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			requestsExpectedCount,
+			count,
+		)
 	}
 }
 
@@ -294,3 +370,49 @@ func TestRespHeaderXCacheHitsAppend(t *testing.T) {
 		)
 	}
 }
+
+// Should add a `Strict-Transport-Security` header to HTTPS responses with
+// the max-age given by -hstsMaxAge, and includeSubDomains if
+// -hstsSubDomains is set, regardless of any HSTS header sent by
+// origin.
+func TestRespHeaderStrictTransportSecurity(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if *hstsMaxAge == 0 {
+		t.Skip("HSTS tests require -hstsMaxAge")
+	}
+
+	const headerName = "Strict-Transport-Security"
+	expectedValue := fmt.Sprintf("max-age=%.0f", hstsMaxAge.Seconds())
+	if *hstsSubDomains {
+		expectedValue += "; includeSubDomains"
+	}
+
+	originValues := []string{
+		"",
+		"max-age=0",
+		"max-age=60; includeSubDomains; preload",
+	}
+
+	for _, originValue := range originValues {
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			if originValue != "" {
+				w.Header().Set(headerName, originValue)
+			}
+		})
+
+		req := NewUniqueEdgeGET(t)
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if values := resp.Header[headerName]; len(values) != 1 || values[0] != expectedValue {
+			t.Errorf(
+				"Received incorrect %s header when origin sent %q. Expected %q, got %q",
+				headerName,
+				originValue,
+				expectedValue,
+				values,
+			)
+		}
+	}
+}
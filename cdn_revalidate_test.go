@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// checkForSkipConditionalRequests skips the calling test if the
+// conditionalRequests flag hasn't been set.
+func checkForSkipConditionalRequests(t *testing.T) {
+	if !*conditionalRequests {
+		t.Skip("Conditional revalidation tests require -conditionalRequests")
+	}
+}
+
+// Should revalidate a response with a `Cache-Control: no-cache` header
+// against origin for every client request. The edge may store the object,
+// in which case it can send a conditional request and serve the stored
+// body when origin responds with a 304, but it must not serve it without
+// contacting origin:
+// http://tools.ietf.org/html/rfc7234#section-5.2.2.2
+func TestRevalidateCacheControlNoCache(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const requestsExpectedCount = 3
+	const etagValue = `"revalidate-me"`
+	const expectedBody = "stored but revalidated"
+	var originRequests RequestRecorder
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", etagValue)
+
+		if r.Header.Get("If-None-Match") == etagValue {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount <= requestsExpectedCount; requestCount++ {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+
+		if count := originRequests.Count(); count != requestCount {
+			t.Errorf(
+				"Request %d was not revalidated with origin. Expected %d origin requests, got %d",
+				requestCount,
+				requestCount,
+				count,
+			)
+		}
+	}
+}
+
+// Should never serve a stale object with a `Cache-Control: must-revalidate`
+// header once it has expired, even if origin is down. It must be
+// revalidated or an error returned instead:
+// http://tools.ietf.org/html/rfc7234#section-5.2.2.1
+func TestRevalidateMustRevalidate(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	testRevalidateNeverServedStale(t, "must-revalidate")
+}
+
+// Should never serve a stale object with a `Cache-Control: proxy-revalidate`
+// header once it has expired, even if origin is down. It has the same
+// meaning as must-revalidate for shared caches:
+// http://tools.ietf.org/html/rfc7234#section-5.2.2.7
+func TestRevalidateProxyRevalidate(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	testRevalidateNeverServedStale(t, "proxy-revalidate")
+}
+
+// testRevalidateNeverServedStale populates the cache with a short TTL and
+// the given Cache-Control directive. After the object expires it asserts
+// that the next request is revalidated with origin. After it expires again
+// and all backends have been stopped, it asserts that the edge returns an
+// error rather than the stale object.
+func testRevalidateNeverServedStale(t *testing.T, directive string) {
+	const expectedResponseStale = "going off like stilton"
+	const expectedResponseFresh = "as fresh as daisies"
+
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = respTTL + (respTTL / 2)
+	headerValue := fmt.Sprintf("max-age=%.0f, %s", respTTL.Seconds(), directive)
+
+	// All backends except origin.
+	switchBackendsErrorOnRequest(t, backendsByPriority[1:])
+
+	req := NewUniqueEdgeGET(t)
+
+	var expectedBody string
+	for requestCount := 1; requestCount < 4; requestCount++ {
+		switch requestCount {
+		case 1: // Request 1 populates cache.
+			expectedBody = expectedResponseStale
+		case 2: // Request 2 is revalidated once expired.
+			time.Sleep(respTTLWithBuffer)
+			expectedBody = expectedResponseFresh
+		case 3: // Request 3 must not be served from stale.
+			time.Sleep(respTTLWithBuffer)
+			stopBackends(backendsByPriority)
+		}
+
+		if requestCount < 3 {
+			body := expectedBody
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", headerValue)
+				w.Write([]byte(body))
+			})
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyStr := string(body)
+
+		if requestCount == 3 {
+			if resp.StatusCode < http.StatusInternalServerError {
+				t.Errorf(
+					"Request %d received incorrect status code. Expected 5xx, got %d",
+					requestCount,
+					resp.StatusCode,
+				)
+			}
+			if bodyStr == expectedResponseFresh {
+				t.Errorf("Request %d was served from stale", requestCount)
+			}
+			continue
+		}
+
+		if bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should revalidate an expired object that has an `ETag` by sending a
+// conditional request to origin with an `If-None-Match` header. A 304
+// response from origin should refresh the object's TTL and the original
+// body should continue to be served:
+// http://tools.ietf.org/html/rfc7234#section-4.3
+func TestRevalidateIfNoneMatch(t *testing.T) {
+	checkForSkipConditionalRequests(t)
+	ResetBackends(backendsByPriority)
+
+	testRevalidateWithValidator(t, "ETag", `"revalidate-me"`, "If-None-Match")
+}
+
+// Should revalidate an expired object that has a `Last-Modified` header by
+// sending a conditional request to origin with an `If-Modified-Since`
+// header. A 304 response from origin should refresh the object's TTL and
+// the original body should continue to be served:
+// http://tools.ietf.org/html/rfc7234#section-4.3
+func TestRevalidateIfModifiedSince(t *testing.T) {
+	checkForSkipConditionalRequests(t)
+	ResetBackends(backendsByPriority)
+
+	lastModified := time.Now().UTC().Add(-time.Hour).Format(http.TimeFormat)
+	testRevalidateWithValidator(t, "Last-Modified", lastModified, "If-Modified-Since")
+}
+
+// Should respond to a conditional client request, that matches a fresh
+// object in cache, with a 304 response generated by the edge and without
+// contacting origin.
+func TestRevalidateClientConditionalFromCache(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedStatus = http.StatusNotModified
+	const etagValue = `"revalidate-me"`
+	lastModified := time.Now().UTC().Add(-time.Hour).Format(http.TimeFormat)
+	conditionalHeaders := map[string]string{
+		"If-None-Match":     etagValue,
+		"If-Modified-Since": lastModified,
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Header().Set("ETag", etagValue)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("cacheable request"))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Request with headers %q should not have made it to origin", r.Header)
+		w.Write([]byte("not cached"))
+	})
+
+	for headerName, headerVal := range conditionalHeaders {
+		req.Header = http.Header{}
+		req.Header.Set(headerName, headerVal)
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf(
+				"Request with %q header received incorrect status code. Expected %d, got %d",
+				headerName,
+				expectedStatus,
+				resp.StatusCode,
+			)
+		}
+	}
+}
+
+// testRevalidateWithValidator populates the cache with an object that has a
+// short TTL and the validator response header given by validatorName and
+// validatorValue. After the object expires it asserts that the edge sends a
+// conditional request to origin with conditionName set to validatorValue,
+// that the 304 response from origin results in the original body being
+// served, and that the object's TTL was refreshed.
+func testRevalidateWithValidator(
+	t *testing.T,
+	validatorName string,
+	validatorValue string,
+	conditionName string,
+) {
+	const expectedBody = "stored but revalidated"
+	const requestsExpectedCount = 2
+
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = respTTL + (respTTL / 2)
+	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
+
+	var originRequests RequestRecorder
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+
+		w.Header().Set("Cache-Control", headerValue)
+		w.Header().Set(validatorName, validatorValue)
+
+		if originRequests.Count() == 1 {
+			w.Write([]byte(expectedBody))
+			return
+		}
+
+		if condition := r.Header.Get(conditionName); condition != validatorValue {
+			t.Errorf(
+				"Origin received revalidation with incorrect %q header. Expected %q, got %q",
+				conditionName,
+				validatorValue,
+				condition,
+			)
+			w.Write([]byte("unconditional response"))
+			return
+		}
+
+		w.WriteHeader(http.StatusNotModified)
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 4; requestCount++ {
+		// Request 2 is revalidated once expired. Request 3 comes from the
+		// refreshed object.
+		if requestCount == 2 {
+			time.Sleep(respTTLWithBuffer)
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+
+	if count := originRequests.Count(); count != requestsExpectedCount {
+		t.Errorf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			requestsExpectedCount,
+			count,
+		)
+	}
+}
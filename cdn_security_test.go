@@ -0,0 +1,687 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests in this file make hostile requests to the edge, as an attacker
+// might. Some are written directly to a TLS connection with
+// roundTripRaw(), because net/http refuses to send them.
+
+// Should reject, or forward safely, requests with CR/LF sequences in the
+// URL or a header value. Neither origin nor the client should ever see the
+// sequence split into a separate header. Rejections should be 4xx, because
+// a 5xx suggests that origin received something it couldn't parse.
+func TestSecurityCRLFInjection(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const injectedHeader = "X-Injected"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		if val := r.Header.Get(injectedHeader); val != "" {
+			t.Errorf("Origin received injected %q header for %q", injectedHeader, r.RequestURI)
+		}
+		w.Header().Set("Cache-Control", "private")
+	})
+
+	injections := []struct {
+		Name string
+		Raw  string
+	}{
+		{"encoded CRLF in path", newRawRequest(
+			"GET",
+			"/%0d%0aX-Injected:%20true?nocache="+NewUUID(),
+		)},
+		{"encoded CRLF in query", newRawRequest(
+			"GET",
+			"/?nocache="+NewUUID()+"%0d%0aX-Injected:%20true",
+		)},
+		{"encoded LF in query", newRawRequest(
+			"GET",
+			"/?nocache="+NewUUID()+"%0aX-Injected:%20true",
+		)},
+		{"encoded CRLF in header value", newRawRequest(
+			"GET",
+			"/?nocache="+NewUUID(),
+			"X-Test: foo%0d%0aX-Injected: true",
+		)},
+		{"bare CR in header value", newRawRequest(
+			"GET",
+			"/?nocache="+NewUUID(),
+			"X-Test: foo\rX-Injected: true",
+		)},
+	}
+
+	for _, injection := range injections {
+		resp, err := roundTripRaw(injection.Raw)
+		if err != nil {
+			t.Logf("Edge closed connection for %s: %s", injection.Name, err)
+			continue
+		}
+
+		if val := resp.Header.Get(injectedHeader); val != "" {
+			t.Errorf("Client received injected %q header for %s", injectedHeader, injection.Name)
+		}
+		if resp.StatusCode >= 500 {
+			t.Errorf(
+				"Received incorrect status code for %s. Expected 4xx or success, got %d",
+				injection.Name,
+				resp.StatusCode,
+			)
+		}
+	}
+}
+
+// Should normalise or reject requests with conflicting `Content-Length`
+// and `Transfer-Encoding` headers, so that origin never sees a second
+// request smuggled inside the body of the first. Each smuggled request
+// has a `smuggled` query param. The client closes the connection after
+// the first request, so the edge shouldn't interpret anything left over as
+// a pipelined request of its own. A normal request is made after each
+// attempt, in case the smuggled request was left on a connection between
+// edge and origin and prepended to the next.
+func TestSecurityRequestSmuggling(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		if smuggled := r.URL.Query().Get("smuggled"); smuggled != "" {
+			t.Errorf("Origin received smuggled request %q", smuggled)
+		}
+		w.Header().Set("Cache-Control", "private")
+	})
+
+	newSmuggledRequest := func(name string) string {
+		return "GET /?smuggled=" + name + " HTTP/1.1\r\n" +
+			"Host: " + *edgeHost + "\r\n" +
+			"\r\n"
+	}
+
+	// Edge uses Content-Length and origin uses chunked, or vice versa.
+	clteBody := "0\r\n\r\n" + newSmuggledRequest("CL.TE")
+	teclSmuggled := newSmuggledRequest("TE.CL")
+	teclChunkSize := strconv.FormatInt(int64(len(teclSmuggled)), 16) + "\r\n"
+	teclBody := teclChunkSize + teclSmuggled + "\r\n0\r\n\r\n"
+	// Only one of edge and origin recognises the encoding.
+	teteBody := "0\r\n\r\n" + newSmuggledRequest("TE.TE")
+	// Edge and origin use different lengths.
+	clclBody := newSmuggledRequest("CL.CL")
+
+	attempts := []struct {
+		Name    string
+		Headers []string
+		Body    string
+	}{
+		{"CL.TE", []string{
+			"Content-Length: " + strconv.Itoa(len(clteBody)),
+			"Transfer-Encoding: chunked",
+		}, clteBody},
+		{"TE.CL", []string{
+			"Content-Length: " + strconv.Itoa(len(teclChunkSize)),
+			"Transfer-Encoding: chunked",
+		}, teclBody},
+		{"TE.TE", []string{
+			"Content-Length: " + strconv.Itoa(len(teteBody)),
+			"Transfer-Encoding: chunked",
+			"Transfer-Encoding: x",
+		}, teteBody},
+		{"CL.CL", []string{
+			"Content-Length: 0",
+			"Content-Length: " + strconv.Itoa(len(clclBody)),
+		}, clclBody},
+	}
+
+	for _, attempt := range attempts {
+		raw := "POST /?nocache=" + NewUUID() + " HTTP/1.1\r\n" +
+			"Host: " + *edgeHost + "\r\n" +
+			strings.Join(attempt.Headers, "\r\n") + "\r\n" +
+			"Connection: close\r\n" +
+			"\r\n" +
+			attempt.Body
+
+		resp, err := roundTripRaw(raw)
+		switch {
+		case err != nil:
+			t.Logf("Edge closed connection for %s: %s", attempt.Name, err)
+		case resp.StatusCode >= 500:
+			t.Errorf(
+				"Received incorrect status code for %s. Expected 4xx or success, got %d",
+				attempt.Name,
+				resp.StatusCode,
+			)
+		}
+
+		resp = RoundTripCheckError(t, NewUniqueEdgeGET(t))
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(
+				"Request after %s received incorrect status code. Expected %d, got %d",
+				attempt.Name,
+				http.StatusOK,
+				resp.StatusCode,
+			)
+		}
+	}
+}
+
+// searchRequestLimit binary searches for the largest size, between 1KB and
+// 128KB, of request made by newRequest that the edge accepts, and reports
+// it. Requests beyond the limit should be rejected with a 4xx, rather than
+// a 5xx that suggests the edge forwarded something origin couldn't handle.
+func searchRequestLimit(
+	t *testing.T,
+	name string,
+	newRequest func(size int) *http.Request,
+) {
+	const minSize = 1024
+	const maxSize = 128 * 1024
+
+	accepted := func(size int) bool {
+		resp := RoundTripCheckError(t, newRequest(size))
+		resp.Body.Close()
+
+		if resp.StatusCode < 400 {
+			return true
+		}
+		if resp.StatusCode >= 500 {
+			t.Errorf(
+				"Received incorrect status code for %s of %d bytes. Expected 4xx, got %d",
+				name,
+				size,
+				resp.StatusCode,
+			)
+		}
+
+		return false
+	}
+
+	if !accepted(minSize) {
+		t.Fatalf("Edge rejected %s of %d bytes", name, minSize)
+	}
+	if accepted(maxSize) {
+		t.Logf("Edge accepted %s of %d bytes, which is the most tested", name, maxSize)
+		return
+	}
+
+	lo, hi := minSize, maxSize
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if accepted(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	t.Logf("Edge accepted %s of up to %d bytes", name, lo)
+}
+
+// Should reject request headers beyond its limit with a 4xx. The size is
+// that of a single header's value.
+func TestSecurityRequestHeaderSizeLimit(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	searchRequestLimit(t, "request header", func(size int) *http.Request {
+		req := NewUniqueEdgeGET(t)
+		req.Header.Set("X-Padding", strings.Repeat("a", size))
+
+		return req
+	})
+}
+
+// Should reject URLs beyond its limit with a 4xx. The size is that of the
+// path and query.
+func TestSecurityURLLengthLimit(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	searchRequestLimit(t, "URL", func(size int) *http.Request {
+		req := NewUniqueEdgeGET(t)
+		req.URL.RawQuery += "&padding="
+		req.URL.RawQuery += strings.Repeat("a", size-len(req.URL.RequestURI()))
+
+		return req
+	})
+}
+
+// Should continue to serve normal requests within requestSlowThreshold
+// while -slowlorisConns connections send the headers of a request at one
+// byte per second. Normal requests use new connections, because an
+// existing connection would bypass any limits on accepting them.
+func TestSecuritySlowloris(t *testing.T) {
+	if *slowlorisConns == 0 {
+		t.Skip("Slowloris test requires -slowlorisConns")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	const attackDuration = time.Duration(30 * time.Second)
+	const requestInterval = time.Second
+
+	raw := newRawRequest("GET", "/?nocache="+NewUUID(), "X-Padding: "+strings.Repeat("a", 1024))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	var opened int
+	for i := 0; i < *slowlorisConns; i++ {
+		conn, err := dialEdgeTLS(newEdgeTLSConfig())
+		if err != nil {
+			t.Logf("Edge refused slow connection after %d: %s", opened, err)
+			break
+		}
+		conn.SetDeadline(time.Now().Add(attackDuration + requestTimeout))
+		opened++
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			for j := 0; j < len(raw); j++ {
+				if _, err := conn.Write([]byte{raw[j]}); err != nil {
+					return
+				}
+
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}()
+	}
+
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	normalClient := client.Clone()
+	normalClient.ResponseHeaderTimeout = requestTimeout
+	normalClient.DisableKeepAlives = true
+
+	for start := time.Now(); time.Since(start) < attackDuration; time.Sleep(requestInterval) {
+		requestStart := time.Now()
+		resp, err := normalClient.RoundTrip(NewUniqueEdgeGET(t))
+		duration := time.Since(requestStart)
+
+		if err != nil {
+			t.Fatalf("Request failed with %d slow connections open: %s", opened, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(
+				"Received incorrect status code with %d slow connections open. Expected %d, got %d",
+				opened,
+				http.StatusOK,
+				resp.StatusCode,
+			)
+		}
+		if duration > requestSlowThreshold {
+			t.Errorf("Slow request with %d slow connections open, took: %s", opened, duration)
+		}
+	}
+}
+
+// Should block methods that can reflect a request, including credentials
+// in its headers, back to the client (Cross-Site Tracing) or open tunnels,
+// while forwarding unknown methods to origin. The response should never
+// contain the secret sent in the request's `Cookie` header.
+func TestSecurityDisallowedMethods(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	var receivedMethod string
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedMethod = r.Method
+		w.Header().Set("Cache-Control", "private")
+	})
+
+	methods := []struct {
+		Method  string
+		Target  string
+		Blocked bool
+	}{
+		{"TRACE", "/?nocache=" + NewUUID(), true},
+		{"TRACK", "/?nocache=" + NewUUID(), true},
+		{"CONNECT", *edgeHost + ":443", true},
+		{"FOOBAR", "/?nocache=" + NewUUID(), false},
+	}
+
+	for _, method := range methods {
+		secret := NewUUID()
+		receivedMethod = ""
+
+		resp, err := roundTripRaw(newRawRequest(method.Method, method.Target, "Cookie: secret="+secret))
+		if err != nil {
+			if !method.Blocked {
+				t.Errorf("Edge closed connection for %s and shouldn't have: %s", method.Method, err)
+			}
+			continue
+		}
+
+		switch {
+		case method.Blocked && receivedMethod != "":
+			t.Errorf("Origin received %s request and it shouldn't have", method.Method)
+		case method.Blocked && resp.StatusCode < 400:
+			t.Errorf("Received non-error status code %d for %s", resp.StatusCode, method.Method)
+		case !method.Blocked && receivedMethod != method.Method:
+			t.Errorf(
+				"Origin received incorrect method. Expected %q, got %q",
+				method.Method,
+				receivedMethod,
+			)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		reflected := strings.Contains(string(body), secret)
+		for _, vals := range resp.Header {
+			reflected = reflected || strings.Contains(strings.Join(vals, ","), secret)
+		}
+		if reflected {
+			t.Errorf("Response to %s reflected the request's Cookie header", method.Method)
+		}
+	}
+}
+
+// Should respond with -unknownHostStatus, or any error if that isn't set,
+// to requests with a `Host` header that isn't configured on the service,
+// rather than routing them to our backends. The reserved `.invalid` TLD
+// ensures that the Host can't belong to anyone else.
+func TestSecurityUnknownHost(t *testing.T) {
+	ResetBackends(backendsByPriority)
+	switchBackendsErrorOnRequest(t, backendsByPriority)
+
+	req := NewUniqueEdgeGET(t)
+	req.Host = NewUUID() + ".invalid"
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	switch {
+	case *unknownHostStatus != 0 && resp.StatusCode != *unknownHostStatus:
+		t.Errorf(
+			"Received incorrect status code for unknown Host. Expected %d, got %d",
+			*unknownHostStatus,
+			resp.StatusCode,
+		)
+	case resp.StatusCode < 400:
+		t.Errorf("Received non-error status code %d for unknown Host", resp.StatusCode)
+	}
+}
+
+// Should never serve a clean request with a response that was influenced
+// by headers that an attacker sent and which aren't part of the cache key.
+// Origin mimics an application that trusts each header without a `Vary`,
+// so the edge must either strip the header, add it to the cache key or
+// not cache the response.
+func TestSecurityCachePoisoningUnkeyedHeaders(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cleanBody = "clean response"
+
+	vectors := []struct {
+		Name  string
+		Value string
+	}{
+		{"X-Forwarded-Host", "attacker.invalid"},
+		{"X-Forwarded-Scheme", "http"},
+		{"X-Original-URL", "/poisoned"},
+	}
+
+	for _, vector := range vectors {
+		headerName := vector.Name
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=1800, public")
+			if val := r.Header.Get(headerName); val != "" {
+				w.Write([]byte("poisoned by " + val))
+				return
+			}
+			w.Write([]byte(cleanBody))
+		})
+
+		url := NewUniqueEdgeURL()
+
+		req := NewEdgeRequest(t, "GET", url)
+		req.Header.Set(vector.Name, vector.Value)
+
+		resp := RoundTripCheckError(t, req)
+		resp.Body.Close()
+
+		req = NewEdgeRequest(t, "GET", url)
+		resp = RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bodyStr := string(body); bodyStr != cleanBody {
+			t.Errorf(
+				"Clean request received response poisoned by %q header. Expected %q, got %q",
+				vector.Name,
+				cleanBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should serve the first -rateLimit requests of a burst from one client
+// and then rate limit the client with a 429 and a `Retry-After` header.
+// The burst is twice the limit, to allow for the edge's window resetting
+// during it. Run this on its own, with -run, so that requests from other
+// tests aren't counted.
+func TestSecurityRateLimit(t *testing.T) {
+	if *rateLimit == 0 {
+		t.Skip("Rate limiting tests require -rateLimit")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	limitedAt := 0
+	for i := 1; i <= *rateLimit*2 && limitedAt == 0; i++ {
+		resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			limitedAt = i
+			if resp.Header.Get("Retry-After") == "" {
+				t.Error("Rate limited response didn't have a Retry-After header")
+			}
+		case resp.StatusCode != http.StatusOK:
+			t.Fatalf(
+				"Received incorrect status code for request #%d. Expected %d, got %d",
+				i,
+				http.StatusOK,
+				resp.StatusCode,
+			)
+		}
+	}
+
+	switch {
+	case limitedAt == 0:
+		t.Errorf("Edge didn't rate limit a burst of %d requests", *rateLimit*2)
+	case limitedAt <= *rateLimit:
+		t.Errorf("Edge rate limited request #%d, within the limit of %d", limitedAt, *rateLimit)
+	default:
+		t.Logf("Edge rate limited request #%d", limitedAt)
+	}
+}
+
+// Should block requests to -aclPath with a 403 if the IP address that
+// tests are run from isn't on the allow list, and forward them to origin
+// if it is, according to -aclAllowed.
+func TestSecurityIPAccessControlList(t *testing.T) {
+	if *aclPath == "" {
+		t.Skip("ACL tests require -aclPath")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "allowed through"
+	var originReceived bool
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originReceived = true
+		w.Header().Set("Cache-Control", "private")
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	req.URL.Path = *aclPath
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if *aclAllowed {
+		checkServedByBackend(t, resp, originServer, expectedBody)
+		return
+	}
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf(
+			"Received incorrect status code from IP not on allow list. Expected %d, got %d",
+			http.StatusForbidden,
+			resp.StatusCode,
+		)
+	}
+	if originReceived {
+		t.Error("Origin received request from IP not on allow list and it shouldn't have")
+	}
+}
+
+// newSignedEdgeURL returns a unique URL under -signedURLPath, signed with
+// -signedURLKey to expire at expires. The `token` query param is the hex
+// HMAC-SHA256 of the path and the `expires` query param, which is a Unix
+// timestamp.
+func newSignedEdgeURL(expires time.Time) *url.URL {
+	path := *signedURLPath + NewUUID()
+	expiresStr := strconv.FormatInt(expires.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(*signedURLKey))
+	mac.Write([]byte(path + expiresStr))
+
+	return &url.URL{
+		Scheme: "https",
+		Host:   *edgeHost,
+		Path:   path,
+		RawQuery: url.Values{
+			"expires": []string{expiresStr},
+			"token":   []string{hex.EncodeToString(mac.Sum(nil))},
+		}.Encode(),
+	}
+}
+
+// Should serve signed URLs that haven't expired, and reject with a 403
+// those that have expired, have been tampered with or have no token,
+// without making a request to origin.
+func TestSecuritySignedURLs(t *testing.T) {
+	if *signedURLKey == "" {
+		t.Skip("Signed URL tests require -signedURLKey")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "signed and sealed"
+	var originReceived bool
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originReceived = true
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Write([]byte(expectedBody))
+	})
+
+	valid := newSignedEdgeURL(time.Now().Add(time.Hour))
+	resp := RoundTripCheckError(t, NewEdgeRequest(t, "GET", valid.String()))
+	defer resp.Body.Close()
+
+	checkServedByBackend(t, resp, originServer, expectedBody)
+
+	expired := newSignedEdgeURL(time.Now().Add(-time.Hour))
+	tampered := newSignedEdgeURL(time.Now().Add(time.Hour))
+	tampered.Path += "-tampered"
+	unsigned := newSignedEdgeURL(time.Now().Add(time.Hour))
+	unsigned.RawQuery = ""
+
+	rejections := []struct {
+		Name string
+		URL  *url.URL
+	}{
+		{"expired", expired},
+		{"tampered", tampered},
+		{"unsigned", unsigned},
+	}
+
+	for _, rejection := range rejections {
+		originReceived = false
+
+		resp := RoundTripCheckError(t, NewEdgeRequest(t, "GET", rejection.URL.String()))
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf(
+				"Received incorrect status code for %s URL. Expected %d, got %d",
+				rejection.Name,
+				http.StatusForbidden,
+				resp.StatusCode,
+			)
+		}
+		if originReceived {
+			t.Errorf("Origin received request for %s URL and it shouldn't have", rejection.Name)
+		}
+	}
+}
+
+// Should verify tokens before looking up the cache and never cache
+// rejections, in case the token isn't part of the cache key. A valid URL
+// should be served after a tampered one for the same path is rejected,
+// and a tampered one should still be rejected once the object is cached.
+func TestSecuritySignedURLRejectionNotCached(t *testing.T) {
+	if *signedURLKey == "" {
+		t.Skip("Signed URL tests require -signedURLKey")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "signed and sealed"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Write([]byte(expectedBody))
+	})
+
+	valid := newSignedEdgeURL(time.Now().Add(time.Hour))
+	tampered := *valid
+	tampered.RawQuery = strings.Replace(valid.RawQuery, "token=", "token=00", 1)
+
+	for i, u := range []*url.URL{&tampered, valid, &tampered} {
+		resp := RoundTripCheckError(t, NewEdgeRequest(t, "GET", u.String()))
+		defer resp.Body.Close()
+
+		if u == valid {
+			checkServedByBackend(t, resp, originServer, expectedBody)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf(
+				"Received incorrect status code for tampered URL in request #%d. Expected %d, got %d",
+				i+1,
+				http.StatusForbidden,
+				resp.StatusCode,
+			)
+		}
+	}
+}
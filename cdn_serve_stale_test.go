@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,12 +20,7 @@ func TestServeStaleOriginDown(t *testing.T) {
 	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
 
 	// All backends except origin.
-	for _, backend := range backendsByPriority[1:] {
-		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-			t.Errorf("Server %s received request and it shouldn't have", backend.Name)
-			w.Write([]byte(backend.Name))
-		})
-	}
+	switchBackendsErrorOnRequest(t, backendsByPriority[1:])
 
 	req := NewUniqueEdgeGET(t)
 
@@ -73,12 +69,7 @@ func TestServeStaleOrigin5xx(t *testing.T) {
 	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
 
 	// All backends except origin.
-	for _, backend := range backendsByPriority[1:] {
-		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-			t.Errorf("Server %s received request and it shouldn't have", backend.Name)
-			w.Write([]byte(backend.Name))
-		})
-	}
+	switchBackendsErrorOnRequest(t, backendsByPriority[1:])
 
 	req := NewUniqueEdgeGET(t)
 
@@ -126,3 +117,304 @@ func TestServeStaleOrigin5xx(t *testing.T) {
 		}
 	}
 }
+
+// Should mark stale objects that are served from grace, while origin is
+// down, so that clients can detect staleness. Cloudflare reports `STALE` as
+// its cache status, whereas for Fastly the header and value prefix depend on
+// the service's config, so are given by -staleMarker, e.g. `Warning: 110`.
+// Fresh objects should not be marked.
+// http://tools.ietf.org/html/rfc7234#section-5.5.1
+func TestServeStaleMarkedAsStale(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = 5 * respTTL
+	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
+
+	var isMarkedStale func(resp *http.Response) bool
+	switch {
+	case vendorCloudflare:
+		isMarkedStale = func(resp *http.Response) bool {
+			return cacheStatus(resp) == "STALE"
+		}
+	case vendorFastly:
+		if *staleMarker == "" {
+			t.Skip("Stale marking test requires -staleMarker")
+		}
+
+		var name, prefix string
+		if marker := strings.SplitN(*staleMarker, ":", 2); len(marker) == 2 {
+			name, prefix = strings.TrimSpace(marker[0]), strings.TrimSpace(marker[1])
+		}
+		if name == "" || prefix == "" {
+			t.Fatalf("-staleMarker must be of the form \"Name: value\", got %q", *staleMarker)
+		}
+
+		isMarkedStale = func(resp *http.Response) bool {
+			return strings.HasPrefix(resp.Header.Get(name), prefix)
+		}
+	default:
+		t.Fatal(notImplementedForVendor)
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", headerValue)
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	// Request 1 populates cache, request 2 is served from cache while still
+	// fresh, and request 3 is served from stale.
+	for requestCount := 1; requestCount < 4; requestCount++ {
+		expectedStale := requestCount == 3
+		if expectedStale {
+			time.Sleep(respTTLWithBuffer)
+			stopBackends(backendsByPriority)
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount,
+				http.StatusOK,
+				resp.StatusCode,
+			)
+		}
+		if stale := isMarkedStale(resp); stale != expectedStale {
+			t.Errorf(
+				"Request %d marked as stale incorrectly. Expected %t, got %t. Headers: %v",
+				requestCount,
+				expectedStale,
+				stale,
+				resp.Header,
+			)
+		}
+	}
+}
+
+// Should serve a stale object immediately, without waiting for origin, if
+// it is beyond TTL but within the `Cache-Control: stale-while-revalidate=n`
+// window. A single request should be made to origin in the background to
+// refresh the object, which is then served to subsequent requests.
+func TestServeStaleWhileRevalidate(t *testing.T) {
+	if !*staleWhileRevalidate {
+		t.Skip("Stale-while-revalidate test requires -staleWhileRevalidate")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	const expectedResponseStale = "going off like stilton"
+	const expectedResponseFresh = "as fresh as daisies"
+
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = respTTL + (respTTL / 2)
+	const staleWindow = time.Duration(60 * time.Second)
+	// Origin is slow to respond to revalidation so that we can tell whether
+	// or not the client was made to wait for it.
+	const revalidateLatency = time.Duration(3 * time.Second)
+	const waitForRevalidate = revalidateLatency * 2
+
+	headerValue := fmt.Sprintf(
+		"max-age=%.0f, stale-while-revalidate=%.0f",
+		respTTL.Seconds(),
+		staleWindow.Seconds(),
+	)
+
+	var originRequests RequestRecorder
+	var expiredAt time.Time
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+		w.Header().Set("Cache-Control", headerValue)
+
+		if originRequests.Count() == 1 {
+			w.Write([]byte(expectedResponseStale))
+		} else {
+			time.Sleep(revalidateLatency)
+			w.Write([]byte(expectedResponseFresh))
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	var expectedBody string
+	for requestCount := 1; requestCount < 4; requestCount++ {
+		switch requestCount {
+		case 1: // Request 1 populates cache.
+			expectedBody = expectedResponseStale
+		case 2: // Request 2 served from stale, triggers revalidation.
+			time.Sleep(respTTLWithBuffer)
+			expiredAt = time.Now()
+			expectedBody = expectedResponseStale
+		case 3: // Request 3 served from the revalidated object.
+			time.Sleep(waitForRevalidate)
+			expectedBody = expectedResponseFresh
+		}
+
+		start := time.Now()
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if duration := time.Since(start); duration >= revalidateLatency {
+			t.Errorf(
+				"Request %d waited for origin to respond. Took %s",
+				requestCount,
+				duration,
+			)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+
+	const expectedOriginRequests = 2
+	originTimes := originRequests.Times()
+	if count := len(originTimes); count != expectedOriginRequests {
+		t.Fatalf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			expectedOriginRequests,
+			count,
+		)
+	}
+	if revalidatedAt := originTimes[1]; revalidatedAt.Before(expiredAt) {
+		t.Errorf(
+			"Origin received background request at %s, before object expired at %s",
+			revalidatedAt,
+			expiredAt,
+		)
+	}
+}
+
+// Should serve stale object if origin is down and object is beyond TTL but
+// within the `Cache-Control: stale-if-error=n` window. Should return an
+// error once the window has lapsed.
+func TestServeStaleIfErrorOriginDown(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const staleWindow = time.Duration(10 * time.Second)
+	headerValue := fmt.Sprintf("stale-if-error=%.0f", staleWindow.Seconds())
+
+	testServeStaleUntilWindowLapsed(t, headerValue, staleWindow, func() {
+		stopBackends(backendsByPriority)
+	})
+}
+
+// Should serve stale object if origin returns a 5xx response and object is
+// beyond TTL but within the `Cache-Control: stale-if-error=n` window.
+// Should return an error once the window has lapsed.
+func TestServeStaleIfErrorOrigin5xx(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const staleWindow = time.Duration(10 * time.Second)
+	headerValue := fmt.Sprintf("stale-if-error=%.0f", staleWindow.Seconds())
+
+	testServeStaleUntilWindowLapsed(t, headerValue, staleWindow, func() {
+		for _, backend := range backendsByPriority {
+			backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(backend.Name))
+			})
+		}
+	})
+}
+
+// Should serve stale object if all backends are down and object is beyond
+// TTL but within the grace window configured on the edge by -graceWindow.
+// Should return an error once the grace window has lapsed.
+func TestServeStaleGraceWindowLapsed(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if *graceWindow == 0 {
+		t.Skip("Grace expiry tests require -graceWindow")
+	}
+
+	testServeStaleUntilWindowLapsed(t, "", *graceWindow, func() {
+		stopBackends(backendsByPriority)
+	})
+}
+
+// testServeStaleUntilWindowLapsed populates the cache with an object that
+// has a short TTL, plus any extra Cache-Control directives given by
+// staleDirective. Once the TTL has expired it calls breakBackends, which
+// should cause every backend to fail, and asserts that the stale object is
+// served until staleWindow has lapsed, after which an error should be
+// returned.
+func testServeStaleUntilWindowLapsed(
+	t *testing.T,
+	staleDirective string,
+	staleWindow time.Duration,
+	breakBackends func(),
+) {
+	const expectedBody = "going off like stilton"
+	const expectedErrorStatus = http.StatusServiceUnavailable
+
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = respTTL + (respTTL / 2)
+	var staleWindowWithBuffer = staleWindow + (staleWindow / 2)
+
+	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
+	if staleDirective != "" {
+		headerValue += ", " + staleDirective
+	}
+
+	// All backends except origin.
+	switchBackendsErrorOnRequest(t, backendsByPriority[1:])
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", headerValue)
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 4; requestCount++ {
+		switch requestCount {
+		case 2: // Request 2 from stale.
+			time.Sleep(respTTLWithBuffer)
+			breakBackends()
+		case 3: // Request 3 after the stale window has lapsed.
+			time.Sleep(staleWindowWithBuffer)
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if requestCount == 3 {
+			if resp.StatusCode != expectedErrorStatus {
+				t.Errorf(
+					"Request %d received incorrect status code. Expected %d, got %d",
+					requestCount,
+					expectedErrorStatus,
+					resp.StatusCode,
+				)
+			}
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
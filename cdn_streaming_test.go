@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkForSkipStreaming skips the calling test if the streaming flag hasn't
+// been set.
+func checkForSkipStreaming(t *testing.T) {
+	if !*streaming {
+		t.Skip("Streaming tests require -streaming")
+	}
+}
+
+// Should stream a chunked response from origin to the client as it is
+// received, rather than waiting for the whole response, by measuring the
+// time to first byte. The complete response should then be cached and
+// served to subsequent requests with a correct `Content-Length`.
+func TestStreamingChunkedResponse(t *testing.T) {
+	checkForSkipStreaming(t)
+	ResetBackends(backendsByPriority)
+
+	const chunkDelay = time.Duration(1 * time.Second)
+	const requestsExpectedCount = 1
+	chunks := []string{
+		"first chunk\n",
+		"second chunk\n",
+		"third chunk\n",
+		"fourth chunk\n",
+	}
+	expectedBody := strings.Join(chunks, "")
+	maxTimeToFirstByte := chunkDelay * time.Duration(len(chunks)-1)
+	var originRequests RequestRecorder
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+
+		// Flushing without a Content-Length results in chunked encoding.
+		flusher := w.(http.Flusher)
+		for count, chunk := range chunks {
+			if count > 0 {
+				time.Sleep(chunkDelay)
+			}
+			w.Write([]byte(chunk))
+			flusher.Flush()
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	start := time.Now()
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	firstByte := make([]byte, 1)
+	if _, err := resp.Body.Read(firstByte); err != nil {
+		t.Fatal(err)
+	}
+	if timeToFirstByte := time.Since(start); timeToFirstByte >= maxTimeToFirstByte {
+		t.Errorf(
+			"Chunked response was not streamed. Expected first byte within %s, took %s",
+			maxTimeToFirstByte,
+			timeToFirstByte,
+		)
+	}
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(firstByte) + string(rest); bodyStr != expectedBody {
+		t.Errorf(
+			"Streamed request received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.ContentLength != int64(len(expectedBody)) {
+		t.Errorf(
+			"Cached request received incorrect Content-Length. Expected %d, got %d",
+			len(expectedBody),
+			resp.ContentLength,
+		)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Cached request received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+
+	if count := originRequests.Count(); count != requestsExpectedCount {
+		t.Errorf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			requestsExpectedCount,
+			count,
+		)
+	}
+}
+
+// Should forward each event of a Server-Sent Events stream as soon as
+// origin sends it, rather than buffering the whole response, and never
+// cache the stream. Each event should arrive within half an interval of
+// being sent, and a second request should receive a new stream from origin.
+func TestStreamingServerSentEvents(t *testing.T) {
+	checkForSkipStreaming(t)
+	ResetBackends(backendsByPriority)
+
+	const eventCount = 4
+	const eventInterval = time.Duration(1 * time.Second)
+	const eventTolerance = eventInterval / 2
+	const requestsExpectedCount = 2
+	var originRequests RequestRecorder
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		originRequests.Record()
+		streamID := NewUUID()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		flusher := w.(http.Flusher)
+		flusher.Flush()
+
+		for count := 1; count <= eventCount; count++ {
+			time.Sleep(eventInterval)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", count, streamID)
+			flusher.Flush()
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+	var streamIDs []string
+
+	for i := 0; i < requestsExpectedCount; i++ {
+		start := time.Now()
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+			t.Errorf(
+				"Received incorrect Content-Type. Expected %q, got %q",
+				"text/event-stream",
+				contentType,
+			)
+		}
+
+		reader := bufio.NewReader(resp.Body)
+		for count := 1; count <= eventCount; {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Stream ended before event #%d: %s", count, err)
+			}
+
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			sentAt := eventInterval * time.Duration(count)
+			if late := time.Since(start) - sentAt; late > eventTolerance {
+				t.Errorf(
+					"Event #%d was buffered. Expected within %s, arrived %s late",
+					count,
+					eventTolerance,
+					late,
+				)
+			}
+			if count == 1 {
+				streamIDs = append(streamIDs, strings.TrimSpace(strings.TrimPrefix(line, "data: ")))
+			}
+			count++
+		}
+	}
+
+	if count := originRequests.Count(); count != requestsExpectedCount {
+		t.Errorf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			requestsExpectedCount,
+			count,
+		)
+	}
+	if len(streamIDs) == 2 && streamIDs[0] == streamIDs[1] {
+		t.Errorf("Second request received the same stream, %q, from cache", streamIDs[0])
+	}
+}
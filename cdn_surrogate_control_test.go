@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The `Surrogate-Control` header allows origin to instruct the edge how to
+// cache an object, separately from the `Cache-Control` header that is
+// delivered to clients:
+// http://www.w3.org/TR/edge-arch/
+
+// checkForSurrogateControl skips the calling test if the selected vendor
+// doesn't support the `Surrogate-Control` header.
+func checkForSurrogateControl(t *testing.T) {
+	if vendorCloudflare {
+		t.Skip(notSupportedByVendor)
+	}
+}
+
+// Should cache responses for the period defined in a `Surrogate-Control:
+// max-age=n` response header.
+func TestSurrogateControlMaxAge(t *testing.T) {
+	checkForSurrogateControl(t)
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(5 * time.Second)
+	headerValue := fmt.Sprintf("max-age=%.0f", cacheDuration.Seconds())
+
+	handler := func(w http.ResponseWriter) {
+		w.Header().Set("Surrogate-Control", headerValue)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	testRequestsCachedDuration(t, req, handler, cacheDuration, http.StatusOK)
+}
+
+// Should cache responses for the period defined in a `Surrogate-Control:
+// max-age=n` response header when a `Cache-Control: max-age=n*2` header is
+// also present.
+func TestSurrogateControlPrecedence(t *testing.T) {
+	checkForSurrogateControl(t)
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(5 * time.Second)
+	const cacheControlDuration = cacheDuration * 2
+
+	surrogateControlValue := fmt.Sprintf("max-age=%.0f", cacheDuration.Seconds())
+	cacheControlValue := fmt.Sprintf("max-age=%.0f", cacheControlDuration.Seconds())
+
+	handler := func(w http.ResponseWriter) {
+		w.Header().Set("Surrogate-Control", surrogateControlValue)
+		w.Header().Set("Cache-Control", cacheControlValue)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	testRequestsCachedDuration(t, req, handler, cacheDuration, http.StatusOK)
+}
+
+// Should strip the `Surrogate-Control` header from responses delivered to
+// clients, because it is only intended for the edge.
+func TestSurrogateControlStripped(t *testing.T) {
+	checkForSurrogateControl(t)
+	ResetBackends(backendsByPriority)
+
+	req := NewUniqueEdgeGET(t)
+	testResponseHeaderStripped(t, req, "Surrogate-Control", "max-age=1800")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// These types are the minimum required to parse an OCSP response with
+// encoding/asn1, as defined by RFC 6960:
+// http://tools.ietf.org/html/rfc6960#section-4.2.1
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspStatusSuccessful and oidOCSPBasic identify a successful response that
+// contains a basic OCSP response.
+const ocspStatusSuccessful = 0
+
+var oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// parseOCSPResponse parses a DER encoded OCSP response and returns the
+// single response for the certificate with the given serial number. The
+// response's signature isn't verified.
+func parseOCSPResponse(der []byte, serial *big.Int) (*ocspSingleResponse, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != ocspStatusSuccessful {
+		return nil, fmt.Errorf("OCSP response status is %d, not successful", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, fmt.Errorf("OCSP response type %s is unsupported", resp.Response.ResponseType)
+	}
+
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, err
+	}
+
+	for _, single := range basic.TBSResponseData.Responses {
+		if single.CertID.SerialNumber.Cmp(serial) == 0 {
+			return &single, nil
+		}
+	}
+
+	return nil, fmt.Errorf("OCSP response doesn't contain certificate serial %s", serial)
+}
+
+// Should staple a valid OCSP response to the TLS handshake, so that clients
+// don't need to make their own OCSP requests, which are slow and reveal the
+// sites they visit. The response must be for the edge's certificate, report
+// it as good, and be current. Its signature isn't verified.
+func TestTLSOCSPStapling(t *testing.T) {
+	if !*ocspStapling {
+		t.Skip("OCSP stapling test requires -ocspStapling")
+	}
+
+	config := newEdgeTLSConfig()
+	config.InsecureSkipVerify = true
+
+	conn, err := dialEdgeTLS(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if len(state.OCSPResponse) == 0 {
+		t.Fatal("Edge didn't staple an OCSP response to the handshake")
+	}
+
+	single, err := parseOCSPResponse(state.OCSPResponse, state.PeerCertificates[0].SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !single.Good {
+		t.Error("Stapled OCSP response doesn't report certificate as good")
+	}
+
+	now := time.Now()
+	if single.ThisUpdate.After(now) {
+		t.Errorf("Stapled OCSP response isn't valid until %s", single.ThisUpdate)
+	}
+	if !single.NextUpdate.IsZero() && single.NextUpdate.Before(now) {
+		t.Errorf("Stapled OCSP response expired at %s", single.NextUpdate)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests in this file make TLS handshakes with the edge directly, rather
+// than HTTP requests, so that the negotiated connection can be inspected.
+
+// tlsVersions maps the names used by -tlsMinVersion to TLS versions, in
+// ascending order.
+var tlsVersions = []struct {
+	Name    string
+	Version uint16
+}{
+	{"1.0", tls.VersionTLS10},
+	{"1.1", tls.VersionTLS11},
+	{"1.2", tls.VersionTLS12},
+	{"1.3", tls.VersionTLS13},
+}
+
+// Should only complete handshakes for TLS versions that are equal to or
+// greater than -tlsMinVersion. Not every edge supports TLS 1.3 yet, so a
+// failed 1.3 handshake is reported for information rather than failing.
+func TestTLSProtocolVersions(t *testing.T) {
+	if *tlsMinVersion == "" {
+		t.Skip("Protocol version tests require -tlsMinVersion")
+	}
+
+	var minVersion uint16
+	for _, v := range tlsVersions {
+		if v.Name == *tlsMinVersion {
+			minVersion = v.Version
+		}
+	}
+	if minVersion == 0 {
+		t.Fatalf("Unrecognised -tlsMinVersion %q", *tlsMinVersion)
+	}
+
+	for _, v := range tlsVersions {
+		config := newEdgeTLSConfig()
+		config.MinVersion = v.Version
+		config.MaxVersion = v.Version
+
+		expectedSuccess := v.Version >= minVersion
+
+		conn, err := dialEdgeTLS(config)
+		if err == nil {
+			conn.Close()
+		}
+
+		switch {
+		case expectedSuccess && err != nil && v.Version == tls.VersionTLS13:
+			t.Logf("TLS %s handshake failed, so edge doesn't support it: %s", v.Name, err)
+		case expectedSuccess && err != nil:
+			t.Errorf("TLS %s handshake failed and should have succeeded: %s", v.Name, err)
+		case !expectedSuccess && err == nil:
+			t.Errorf("TLS %s handshake succeeded and should have failed", v.Name)
+		}
+	}
+}
+
+// Should reject handshakes that only offer weak cipher suites. CBC suites
+// are only expected to be rejected if -cbcRejected is set. Suites can only
+// be chosen for TLS 1.2 and below, so that is the maximum version.
+func TestTLSWeakCipherSuitesRejected(t *testing.T) {
+	type weakSuite struct {
+		Name   string
+		Suites []uint16
+	}
+
+	weakSuites := []weakSuite{
+		{"RC4", []uint16{
+			tls.TLS_RSA_WITH_RC4_128_SHA,
+			tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+		}},
+		{"3DES", []uint16{
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+		}},
+	}
+	if *cbcRejected {
+		weakSuites = append(weakSuites, weakSuite{"CBC", []uint16{
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		}})
+	}
+
+	for _, weak := range weakSuites {
+		config := newEdgeTLSConfig()
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = weak.Suites
+
+		conn, err := dialEdgeTLS(config)
+		if err != nil {
+			continue
+		}
+
+		t.Errorf(
+			"Handshake offering only %s cipher suites succeeded, negotiating %s",
+			weak.Name,
+			tls.CipherSuiteName(conn.ConnectionState().CipherSuite),
+		)
+		conn.Close()
+	}
+}
+
+// Should accept at least one of the cipher suites that Go considers secure
+// for TLS 1.2. Each suite is offered on its own and those accepted are
+// reported for information.
+func TestTLSCipherSuitesAccepted(t *testing.T) {
+	var accepted []string
+
+	for _, suite := range tls.CipherSuites() {
+		var supportsTLS12 bool
+		for _, version := range suite.SupportedVersions {
+			if version == tls.VersionTLS12 {
+				supportsTLS12 = true
+			}
+		}
+		if !supportsTLS12 {
+			continue
+		}
+
+		config := newEdgeTLSConfig()
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = []uint16{suite.ID}
+
+		conn, err := dialEdgeTLS(config)
+		if err != nil {
+			continue
+		}
+
+		accepted = append(accepted, suite.Name)
+		conn.Close()
+	}
+
+	if len(accepted) == 0 {
+		t.Fatal("Edge didn't accept any secure TLS 1.2 cipher suites")
+	}
+
+	t.Logf("Edge accepted TLS 1.2 cipher suites: %s", strings.Join(accepted, ", "))
+}
+
+// Should resume sessions with session IDs or tickets for each TLS version
+// from 1.2 that edge accepts. A request is made over each connection, and
+// read until the edge closes it, because TLS 1.3 tickets are only sent
+// after the handshake. The latency of full and resumed handshakes, which
+// include connecting, are reported for information.
+func TestTLSSessionResumption(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	for _, v := range tlsVersions {
+		if v.Version < tls.VersionTLS12 {
+			continue
+		}
+
+		config := newEdgeTLSConfig()
+		config.MinVersion = v.Version
+		config.MaxVersion = v.Version
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+		var durations [2]time.Duration
+		for attempt := range durations {
+			start := time.Now()
+			conn, err := dialEdgeTLS(config)
+			durations[attempt] = time.Since(start)
+
+			if err != nil {
+				// Versions below -tlsMinVersion are covered by
+				// TestTLSProtocolVersions.
+				t.Logf("TLS %s handshake failed: %s", v.Name, err)
+				break
+			}
+
+			fmt.Fprintf(conn, "HEAD / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", *edgeHost)
+			ioutil.ReadAll(conn)
+			conn.Close()
+
+			resumed := conn.ConnectionState().DidResume
+			switch {
+			case attempt == 0 && resumed:
+				t.Errorf("TLS %s handshake resumed a session and there shouldn't have been one", v.Name)
+			case attempt == 1 && !resumed:
+				t.Errorf("TLS %s handshake didn't resume the previous session", v.Name)
+			case attempt == 1:
+				t.Logf(
+					"TLS %s full handshake took %s, resumed handshake took %s, difference %s",
+					v.Name,
+					durations[0],
+					durations[1],
+					durations[0]-durations[1],
+				)
+			}
+		}
+	}
+}
+
+// edgeCertificates returns the certificate chain served by the edge,
+// without verifying it, so that tests can inspect it. If the handshake
+// fails then the calling test will be aborted.
+func edgeCertificates(t *testing.T) []*x509.Certificate {
+	config := newEdgeTLSConfig()
+	config.InsecureSkipVerify = true
+
+	conn, err := dialEdgeTLS(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates
+}
+
+// Should serve a complete certificate chain, which can be verified against
+// the system's roots using only the intermediates served by the edge.
+func TestTLSCertificateChainComplete(t *testing.T) {
+	if *skipVerifyTLS {
+		t.Skip("Certificate chain can't be verified with -skipVerifyTLS")
+	}
+
+	certs := edgeCertificates(t)
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		t.Errorf("Unable to verify certificate chain served by edge: %s", err)
+	}
+}
+
+// Should serve certificates that won't expire for at least the number of
+// days given by -certExpiryDays.
+func TestTLSCertificateExpiry(t *testing.T) {
+	if *skipVerifyTLS {
+		t.Skip("Certificate expiry isn't checked with -skipVerifyTLS")
+	}
+
+	minExpiry := time.Now().AddDate(0, 0, *certExpiryDays)
+
+	for _, cert := range edgeCertificates(t) {
+		if cert.NotAfter.Before(minExpiry) {
+			t.Errorf(
+				"Certificate %q expires within %d days, on %s",
+				cert.Subject.CommonName,
+				*certExpiryDays,
+				cert.NotAfter,
+			)
+		}
+	}
+}
+
+// Should serve a certificate that covers each of the hostnames given by
+// -certHostnames, such as the apex and www of a domain.
+func TestTLSCertificateHostnames(t *testing.T) {
+	if *skipVerifyTLS {
+		t.Skip("Certificate hostnames can't be verified with -skipVerifyTLS")
+	}
+
+	hostnames := []string{*edgeHost}
+	if *certHostnames != "" {
+		hostnames = strings.Split(*certHostnames, ",")
+	}
+
+	cert := edgeCertificates(t)[0]
+
+	for _, hostname := range hostnames {
+		hostname = strings.TrimSpace(hostname)
+		if err := cert.VerifyHostname(hostname); err != nil {
+			t.Errorf("Certificate doesn't cover hostname %q: %s", hostname, err)
+		}
+	}
+}
+
+// Should reject handshakes without SNI if -sniRequired is set, otherwise
+// complete them with a default certificate, which is reported for
+// information because it may not cover -edgeHost in shared-certificate
+// setups.
+func TestTLSHandshakeWithoutSNI(t *testing.T) {
+	config := newEdgeTLSConfig()
+	config.ServerName = ""
+	config.InsecureSkipVerify = true
+
+	conn, err := dialEdgeTLS(config)
+	if err != nil {
+		if !*sniRequired {
+			t.Errorf("Handshake without SNI failed and should have succeeded: %s", err)
+		}
+		return
+	}
+	defer conn.Close()
+
+	if *sniRequired {
+		t.Error("Handshake without SNI succeeded and should have failed")
+		return
+	}
+
+	cert := conn.ConnectionState().PeerCertificates[0]
+	t.Logf(
+		"Edge served default certificate %q for DNS names %q",
+		cert.Subject.CommonName,
+		cert.DNSNames,
+	)
+}
+
+// Should negotiate HTTP/2 with ALPN when the client offers it.
+func TestTLSALPNNegotiatesHTTP2(t *testing.T) {
+	checkForSkipHTTP2(t)
+
+	const expectedProtocol = "h2"
+
+	config := newEdgeTLSConfig()
+	config.NextProtos = []string{expectedProtocol, "http/1.1"}
+
+	conn, err := dialEdgeTLS(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != expectedProtocol {
+		t.Errorf(
+			"Negotiated incorrect protocol with ALPN. Expected %q, got %q",
+			expectedProtocol,
+			protocol,
+		)
+	}
+}
+
+// Should continue to serve clients that only support HTTP/1.1, and
+// advertise HTTP/3 with an `Alt-Svc` header if -http3 is set. The client
+// only offers HTTP/1.1, regardless of -http2.
+func TestTLSALPNHTTP1Client(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	config := newEdgeTLSConfig()
+	config.NextProtos = []string{"http/1.1"}
+
+	conn, err := dialEdgeTLS(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "" && protocol != "http/1.1" {
+		t.Errorf("Negotiated unexpected protocol with ALPN for HTTP/1.1 client: %q", protocol)
+	}
+
+	http1Client := client.Clone()
+	http1Client.ForceAttemptHTTP2 = false
+	http1Client.TLSClientConfig.NextProtos = []string{"http/1.1"}
+
+	resp, err := http1Client.RoundTrip(NewUniqueEdgeGET(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+		t.Errorf(
+			"HTTP/1.1 client received incorrect response. Expected 200 over HTTP/1.x, got %d over %s",
+			resp.StatusCode,
+			resp.Proto,
+		)
+	}
+
+	if *http3 {
+		if altSvc := resp.Header.Get("Alt-Svc"); !strings.Contains(altSvc, "h3") {
+			t.Errorf("Alt-Svc header doesn't advertise HTTP/3. Got %q", altSvc)
+		}
+	}
+}
+
+// Should only connect to an origin that presents an invalid certificate if
+// -verifyOriginTLS isn't set, because deployments differ. Origin is
+// restarted with the self-signed certificate from `httptest.Server`, which
+// is only valid for example.com, and restored afterwards. If the edge
+// verifies origin then the request should instead be served by the first
+// mirror, unless failover is disabled, in which case it should fail.
+func TestTLSOriginCertificateVerification(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const originBody = "served over invalid TLS"
+	const backupBody = "lucky golden ticket"
+
+	originCerts := originServer.TLSCerts
+	defer func() {
+		// The next call to ResetBackends() will start it with the
+		// original certs.
+		originServer.Stop()
+		originServer.TLSCerts = originCerts
+	}()
+
+	originServer.Stop()
+	originServer.TLSCerts = nil
+	originServer.Start()
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		if *verifyOriginTLS {
+			t.Error("Edge connected to origin with an invalid certificate")
+		}
+		w.Write([]byte(originBody))
+	})
+	if !*skipFailover {
+		backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(backupBody))
+		})
+	}
+
+	resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+
+	switch {
+	case !*verifyOriginTLS:
+		checkServedByBackend(t, resp, originServer, originBody)
+	case !*skipFailover:
+		checkServedByBackend(t, resp, backupServer1, backupBody)
+	case resp.StatusCode < 500:
+		t.Errorf("Received non-error status code %d from origin with an invalid certificate", resp.StatusCode)
+	}
+}
+
+// Should present a client certificate signed by -originClientCA when
+// connecting to origin, so that origins can be shielded from anything but
+// the edge. All backends require and verify client certificates when the
+// flag is set, so the handshake would fail otherwise; the handler checks
+// what was presented.
+func TestTLSOriginMutualTLS(t *testing.T) {
+	if *originClientCA == "" {
+		t.Skip("Origin mutual TLS not configured")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "only for the edge"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.TLS == nil:
+			t.Error("Edge connected to origin without TLS")
+		case len(r.TLS.VerifiedChains) == 0:
+			t.Error("Edge didn't present a client certificate signed by -originClientCA")
+		default:
+			t.Logf("Edge presented client certificate for %q", r.TLS.VerifiedChains[0][0].Subject)
+		}
+		w.Write([]byte(expectedBody))
+	})
+
+	resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+
+	checkServedByBackend(t, resp, originServer, expectedBody)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests in this file speak just enough of the WebSocket protocol (RFC
+// 6455) to exchange small text frames, on hijacked connections at origin
+// and raw connections from the client.
+
+// websocketGUID is appended to `Sec-WebSocket-Key` to derive
+// `Sec-WebSocket-Accept`.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketAccept returns the `Sec-WebSocket-Accept` value for key.
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// writeWebSocketFrame writes payload as a single text frame, which must be
+// masked if sent by a client.
+func writeWebSocketFrame(w io.Writer, payload []byte, masked bool) error {
+	if len(payload) > 125 {
+		return errors.New("WebSocket payload too large for a single byte length")
+	}
+
+	header := []byte{0x81, byte(len(payload))}
+	if !masked {
+		_, err := w.Write(append(header, payload...))
+		return err
+	}
+
+	mask := make([]byte, 4)
+	rand.Read(mask)
+
+	maskedPayload := make([]byte, len(payload))
+	for i := range payload {
+		maskedPayload[i] = payload[i] ^ mask[i%4]
+	}
+
+	header[1] |= 0x80
+	frame := append(append(header, mask...), maskedPayload...)
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// readWebSocketFrame reads a single frame and returns its unmasked
+// payload.
+func readWebSocketFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if mask != nil {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return payload, nil
+}
+
+// websocketEchoHandler completes the WebSocket handshake and then echoes
+// each frame received back to the client, until the connection is closed.
+// Requests that aren't upgrades are refused with a 426.
+func websocketEchoHandler(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+			w.WriteHeader(http.StatusUpgradeRequired)
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(
+			buf,
+			"HTTP/1.1 101 Switching Protocols\r\n"+
+				"Upgrade: websocket\r\n"+
+				"Connection: Upgrade\r\n"+
+				"Sec-WebSocket-Accept: %s\r\n"+
+				"\r\n",
+			websocketAccept(key),
+		)
+		if err := buf.Flush(); err != nil {
+			return
+		}
+
+		for {
+			payload, err := readWebSocketFrame(buf.Reader)
+			if err != nil {
+				return
+			}
+			if err := writeWebSocketFrame(conn, payload, false); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Should pass WebSocket handshakes through to origin, if -websockets is
+// set, and then frames in both directions within requestSlowThreshold.
+// Otherwise the edge should refuse to upgrade the connection, by any
+// response other than a 101.
+func TestWebSocketPassThrough(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const frameCount = 5
+
+	originServer.SwitchHandler(websocketEchoHandler(t))
+
+	config := newEdgeTLSConfig()
+	config.NextProtos = []string{"http/1.1"}
+
+	conn, err := dialEdgeTLS(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !*websockets {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			t.Error("Edge upgraded WebSocket connection and shouldn't have")
+		}
+		t.Logf("Edge refused WebSocket upgrade with status %d", resp.StatusCode)
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf(
+			"Received incorrect status code for WebSocket handshake. Expected %d, got %d",
+			http.StatusSwitchingProtocols,
+			resp.StatusCode,
+		)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != websocketAccept(key) {
+		t.Errorf(
+			"Received incorrect Sec-WebSocket-Accept header. Expected %q, got %q",
+			websocketAccept(key),
+			accept,
+		)
+	}
+
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	for i := 1; i <= frameCount; i++ {
+		sent := fmt.Sprintf("frame #%d", i)
+
+		start := time.Now()
+		if err := writeWebSocketFrame(conn, []byte(sent), true); err != nil {
+			t.Fatal(err)
+		}
+		received, err := readWebSocketFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		duration := time.Since(start)
+
+		if string(received) != sent {
+			t.Errorf("Received incorrect WebSocket frame. Expected %q, got %q", sent, received)
+		}
+		if duration > requestSlowThreshold {
+			t.Errorf("Slow WebSocket frame round trip, took: %s", duration)
+		}
+	}
+}
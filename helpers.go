@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -15,28 +17,38 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // CDNBackendServer is a backend server which will receive and respond to
-// requests from the CDN.
+// requests from the CDN. If ClientCAs is set then the CDN must present a
+// client certificate signed by one of them.
 type CDNBackendServer struct {
-	Name     string
-	Port     int
-	TLSCerts []tls.Certificate
-	handler  func(w http.ResponseWriter, r *http.Request)
-	server   *httptest.Server
+	Name      string
+	Port      int
+	TLSCerts  []tls.Certificate
+	ClientCAs *x509.CertPool
+	handler   func(w http.ResponseWriter, r *http.Request)
+	server    *httptest.Server
+	release   chan struct{}
+	observer  func(r *http.Request)
 }
 
 // ServeHTTP satisfies the http.HandlerFunc interface. Health check requests
-// for `HEAD` are always served 200 responses. Other requests are passed
-// off to a custom handler provided by SwitchHandler.
+// for `HEAD` are always served 200 responses, after being passed to any
+// observer provided by ObserveProbes. Other requests are passed off to a
+// custom handler provided by SwitchHandler.
 func (s *CDNBackendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Backend-Name", s.Name)
 
         // swallow healtheck requests
 	if r.Method == "HEAD" {
+		if s.observer != nil {
+			s.observer(r)
+		}
 		w.Header().Set("PING", "PONG")
 		return
 	}
@@ -45,17 +57,69 @@ func (s *CDNBackendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // ResetHandler sets the handler back to an empty function that will return
-// a 200 response.
+// a 200 response, and removes any probe observer.
 func (s *CDNBackendServer) ResetHandler() {
-	s.handler = func(w http.ResponseWriter, r *http.Request) {}
+	s.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {})
+	s.observer = nil
+}
+
+// ObserveProbes sets a function to be called with each health check
+// request, so that tests can inspect them. The health check will still be
+// answered as normal.
+func (s *CDNBackendServer) ObserveProbes(f func(r *http.Request)) {
+	s.observer = f
 }
 
 // SwitchHandler sets the handler to a custom function. This is used by
 // tests to pass in their own request inspection and response handler.
 func (s *CDNBackendServer) SwitchHandler(h func(w http.ResponseWriter, r *http.Request)) {
+	s.releaseHungRequests()
 	s.handler = h
 }
 
+// HangRequests sets the handler to one that accepts requests but never
+// responds to them, so that the edge's timeouts can be tested. Health
+// checks are still answered. Hung requests are released, with an empty
+// response, when the handler is next switched or the server is stopped.
+func (s *CDNBackendServer) HangRequests() {
+	release := make(chan struct{})
+	s.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	s.release = release
+}
+
+// releaseHungRequests releases any requests held by HangRequests.
+func (s *CDNBackendServer) releaseHungRequests() {
+	if s.release != nil {
+		close(s.release)
+		s.release = nil
+	}
+}
+
+// WriteRawResponse takes over the connection from a handler's
+// http.ResponseWriter and writes raw bytes to it, bypassing the checks that
+// net/http would otherwise make. This allows tests to produce deliberately
+// broken responses. The connection is closed afterwards.
+func WriteRawResponse(w http.ResponseWriter, raw []byte) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("ResponseWriter doesn't support hijacking")
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := buf.Write(raw); err != nil {
+		return err
+	}
+
+	return buf.Flush()
+}
+
 // IsStarted checks whether the server is currently started.
 func (s *CDNBackendServer) IsStarted() bool {
 	return (s.server != nil)
@@ -65,6 +129,7 @@ func (s *CDNBackendServer) IsStarted() bool {
 // Resets server back to nil, as if the backend had been instantiated but
 // Start() not called.
 func (s *CDNBackendServer) Stop() {
+	s.releaseHungRequests()
 	s.server.Close()
 	s.server = nil
 }
@@ -90,26 +155,89 @@ func (s *CDNBackendServer) Start() {
 	s.server = httptest.NewUnstartedServer(s)
 	s.server.Listener = ln
 
-	if len(s.TLSCerts) > 0 {
-		s.server.TLS = &tls.Config{
-			Certificates: s.TLSCerts,
-		}
+	s.server.TLS = &tls.Config{
+		Certificates: s.TLSCerts,
+	}
+	if s.ClientCAs != nil {
+		s.server.TLS.ClientCAs = s.ClientCAs
+		s.server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
 	s.server.StartTLS()
 	log.Printf("Started server on port %d", s.Port)
 }
 
+// RequestRecorder records the time at which each request was received by a
+// backend handler. The CDN may make requests to origin asynchronously, after
+// the client has already received its response, so it is safe for
+// concurrent use.
+type RequestRecorder struct {
+	mutex sync.Mutex
+	times []time.Time
+}
+
+// Record stores the current time as the arrival of a new request.
+func (r *RequestRecorder) Record() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.times = append(r.times, time.Now())
+}
+
+// Count returns the number of requests recorded so far.
+func (r *RequestRecorder) Count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.times)
+}
+
+// Times returns a copy of the arrival times of all requests recorded so
+// far, in the order that they were received.
+func (r *RequestRecorder) Times() []time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	times := make([]time.Time, len(r.times))
+	copy(times, r.times)
+
+	return times
+}
+
+// SlowHandler is an origin handler that waits for Latency before
+// responding and atomically counts the requests that it has received, so
+// that it can safely be used by concurrent requests. The response body
+// includes the count, so each response from origin is unique.
+type SlowHandler struct {
+	Latency time.Duration
+	hits    int64
+}
+
+// ServeHTTP is intended to be passed to CDNBackendServer.SwitchHandler.
+func (h *SlowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hit := atomic.AddInt64(&h.hits, 1)
+	time.Sleep(h.Latency)
+
+	w.Write([]byte(fmt.Sprintf("response %d", hit)))
+}
+
+// Hits returns the number of requests received so far.
+func (h *SlowHandler) Hits() int64 {
+	return atomic.LoadInt64(&h.hits)
+}
+
 // CachedHostLookup caches DNS lookups for the given `Host` in order to
 // prevent us switching to another edge location in the middle of tests.
+// If IPv6 is set then only IPv6 addresses, from AAAA records, are used.
 type CachedHostLookup struct {
 	Host         string
+	IPv6         bool
 	hardCachedIP string
 }
 
-// lookup performs a DNS lookup and caches the first IP address returned.
-// Subsequent requests always return the cached address, preventing further
-// DNS requests.
+// lookup performs a DNS lookup and caches the first IP address returned,
+// or the first IPv6 address if IPv6 is set. Subsequent requests always
+// return the cached address, preventing further DNS requests.
 func (c *CachedHostLookup) lookup(host string) string {
 	if c.hardCachedIP == "" {
 		ipAddresses, err := net.LookupHost(host)
@@ -117,7 +245,15 @@ func (c *CachedHostLookup) lookup(host string) string {
 			log.Fatal(err)
 		}
 
-		c.hardCachedIP = ipAddresses[0]
+		for _, ipAddress := range ipAddresses {
+			if !c.IPv6 || net.ParseIP(ipAddress).To4() == nil {
+				c.hardCachedIP = ipAddress
+				break
+			}
+		}
+		if c.hardCachedIP == "" {
+			log.Fatalf("No IPv6 addresses found for %q", host)
+		}
 	}
 
 	return c.hardCachedIP
@@ -141,10 +277,11 @@ func (c *CachedHostLookup) Dial(network, addr string) (net.Conn, error) {
 }
 
 // NewCachedDial returns the `Dial` function for a new CachedHostLookup
-// object with the given host.
-func NewCachedDial(host string) func(string, string) (net.Conn, error) {
+// object with the given host, which only uses IPv6 if ipv6 is set.
+func NewCachedDial(host string, ipv6 bool) func(string, string) (net.Conn, error) {
 	c := CachedHostLookup{
 		Host: host,
+		IPv6: ipv6,
 	}
 
 	return c.Dial
@@ -179,16 +316,55 @@ func NewUniqueEdgeURL() string {
 	return url.String()
 }
 
+// NewEdgeRequest constructs a request (but not perform it) with an
+// arbitrary method against a URL on edge, such as one previously returned by
+// NewUniqueEdgeURL(). If there are any errors then the calling test will be
+// aborted.
+func NewEdgeRequest(t *testing.T, method string, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return req
+}
+
 // NewUniqueEdgeGET constructs a GET request (but not perform it) against edge.
 // Uses NewUniqueEdgeURL() to ensure that it hasn't previously been cached. The
 // request method field of the returned object can be later modified if
 // required.
 func NewUniqueEdgeGET(t *testing.T) *http.Request {
-	url := NewUniqueEdgeURL()
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	return NewEdgeRequest(t, "GET", NewUniqueEdgeURL())
+}
+
+// NewEdgePURGE constructs a PURGE request (but not perform it) for a URL on
+// edge. The credentials given by -purgeKey are sent in the header named by
+// -purgeKeyName.
+func NewEdgePURGE(t *testing.T, url string) *http.Request {
+	req := NewEdgeRequest(t, "PURGE", url)
+	req.Header.Set(*purgeKeyName, *purgeKey)
+
+	return req
+}
+
+// NewEdgeSoftPURGE constructs a PURGE request (but not perform it), like
+// NewEdgePURGE(), that asks edge to mark the object as stale rather than
+// removing it from cache.
+func NewEdgeSoftPURGE(t *testing.T, url string) *http.Request {
+	req := NewEdgePURGE(t, url)
+	req.Header.Set("Fastly-Soft-Purge", "1")
+
+	return req
+}
+
+// NewSurrogateKeyPurge constructs a POST request (but not perform it) to
+// the vendor's API, given by -surrogateKeyPurgeURL, that will purge all
+// objects tagged with the given `Surrogate-Key`. The credentials given by
+// -purgeKey are sent in the header named by -purgeKeyName.
+func NewSurrogateKeyPurge(t *testing.T, key string) *http.Request {
+	purgeURL := fmt.Sprintf(*surrogateKeyPurgeURL, url.QueryEscape(key))
+	req := NewEdgeRequest(t, "POST", purgeURL)
+	req.Header.Set(*purgeKeyName, *purgeKey)
 
 	return req
 }
@@ -213,6 +389,269 @@ func RoundTripCheckError(t *testing.T, req *http.Request) *http.Response {
 	return resp
 }
 
+// newEdgeTLSConfig returns a TLS config for handshakes with the edge, which
+// sends the edge's hostname for SNI and honours -skipVerifyTLS.
+func newEdgeTLSConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         *edgeHost,
+		InsecureSkipVerify: *skipVerifyTLS,
+	}
+}
+
+// dialEdgeTLS makes a TLS handshake with the edge, on the same cached
+// address used by client, and returns the connection which the caller must
+// close.
+func dialEdgeTLS(config *tls.Config) (*tls.Conn, error) {
+	rawConn, err := client.Dial("tcp", net.JoinHostPort(*edgeHost, "443"))
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(rawConn, config)
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// newRawRequest returns a raw HTTP/1.1 request for target, which is sent
+// verbatim as the request-target, with the given header lines. The
+// connection is closed after the response.
+func newRawRequest(method string, target string, headers ...string) string {
+	raw := method + " " + target + " HTTP/1.1\r\n" +
+		"Host: " + *edgeHost + "\r\n"
+	for _, header := range headers {
+		raw += header + "\r\n"
+	}
+
+	return raw + "Connection: close\r\n\r\n"
+}
+
+// roundTripRaw writes raw to a new TLS connection to the edge and returns
+// the first response, with its body already read, or an error if the edge
+// closed the connection without responding.
+func roundTripRaw(raw string) (*http.Response, error) {
+	config := newEdgeTLSConfig()
+	config.NextProtos = []string{"http/1.1"}
+
+	conn, err := dialEdgeTLS(config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
+
+// egressPublicIP returns the public IP address that tests are run from,
+// which the edge should see as the client's, from -egressIP. It returns nil
+// if -egressIP isn't set, so that callers can skip their egress checks. If
+// it isn't an IP address then the calling test will be aborted.
+func egressPublicIP(t *testing.T) net.IP {
+	if *egressIP == "" {
+		return nil
+	}
+
+	ip := net.ParseIP(*egressIP)
+	if ip == nil {
+		t.Fatalf("Egress IP %q isn't an IP address", *egressIP)
+	}
+
+	return ip
+}
+
+// checkHeaderSecondsWithin parses the named response header as a whole
+// number of seconds, such as `Age`, and asserts that it is within tolerance
+// of expected, in either direction, to allow for clock skew and request
+// latency. The parsed value is returned so that callers can make further
+// comparisons. If the header is missing or isn't numeric then the calling
+// test will be aborted.
+func checkHeaderSecondsWithin(
+	t *testing.T,
+	resp *http.Response,
+	headerName string,
+	expected time.Duration,
+	tolerance time.Duration,
+) time.Duration {
+	headerVal := resp.Header.Get(headerName)
+	seconds, err := strconv.Atoi(headerVal)
+	if err != nil {
+		t.Fatalf("Received non-numeric %q header. Got %q", headerName, headerVal)
+	}
+
+	received := time.Duration(seconds) * time.Second
+	if diff := received - expected; diff > tolerance || diff < -tolerance {
+		t.Errorf(
+			"Received %q header outside of tolerance. Expected %s (+/- %s), got %s",
+			headerName,
+			expected,
+			tolerance,
+			received,
+		)
+	}
+
+	return received
+}
+
+// cacheStatus returns the edge's cache status, such as "HIT" or "MISS", from
+// the -cacheStatusHeader response header. If the header contains a
+// comma-separated list, because origin or another cache node also set it,
+// then only the last value is returned because that belongs to the edge.
+func cacheStatus(resp *http.Response) string {
+	values := strings.Split(resp.Header.Get(*cacheStatusHeader), ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+// checkCacheStatus asserts that the edge's cache status for the response
+// matches expected, so that tests can verify HIT/MISS transitions explicitly
+// rather than only inferring them from requests seen by origin.
+func checkCacheStatus(t *testing.T, resp *http.Response, expected string) {
+	if status := cacheStatus(resp); status != expected {
+		t.Errorf(
+			"Received incorrect %s header. Expected %q, got %q",
+			*cacheStatusHeader,
+			expected,
+			status,
+		)
+	}
+}
+
+// checkServedByBackend asserts that the response is a 200 with expectedBody
+// and that it came from backend, according to the `Backend-Name` header
+// that every CDNBackendServer sets.
+func checkServedByBackend(
+	t *testing.T,
+	resp *http.Response,
+	backend *CDNBackendServer,
+	expectedBody string,
+) {
+	const expectedStatus = http.StatusOK
+
+	if resp.StatusCode != expectedStatus {
+		t.Errorf(
+			"Received incorrect status code. Expected %d, got %d",
+			expectedStatus,
+			resp.StatusCode,
+		)
+	}
+	if name := resp.Header.Get("Backend-Name"); name != backend.Name {
+		t.Errorf(
+			"Received response from wrong backend. Expected %q, got %q",
+			backend.Name,
+			name,
+		)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
+
+// checkRequestHeaders asserts that the request headers received by the
+// named backend include each of the expected headers and values.
+func checkRequestHeaders(
+	t *testing.T,
+	backendName string,
+	received http.Header,
+	expected map[string]string,
+) {
+	for headerName, expectedVal := range expected {
+		if val := received.Get(headerName); val != expectedVal {
+			t.Errorf(
+				"%s received incorrect %q request header. Expected %q, got %q",
+				backendName,
+				headerName,
+				expectedVal,
+				val,
+			)
+		}
+	}
+}
+
+// checkEachBackendTier makes a request to edge for each tier of backends in
+// backendsByPriority, stopping the preceding tier first so that edge fails
+// over to it, and asserts that the response was served by that backend.
+// The request received by each backend is passed to check, along with the
+// backend's index in backendsByPriority, so that tests can inspect it.
+func checkEachBackendTier(
+	t *testing.T,
+	check func(index int, backend *CDNBackendServer, r *http.Request),
+) {
+	for i, backend := range backendsByPriority {
+		expectedBody := backend.Name + " served this"
+		var receivedReq *http.Request
+
+		// Stop the preceding tier, if any.
+		if i > 0 {
+			backendsByPriority[i-1].Stop()
+		}
+
+		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			receivedReq = r
+			w.Write([]byte(expectedBody))
+		})
+
+		resp := RoundTripCheckError(t, NewUniqueEdgeGET(t))
+		defer resp.Body.Close()
+
+		checkServedByBackend(t, resp, backend, expectedBody)
+
+		if receivedReq == nil {
+			t.Errorf("%s didn't receive request", backend.Name)
+			continue
+		}
+		check(i, backend, receivedReq)
+	}
+}
+
+// switchBackendsErrorOnRequest switches the handler of each of backends so
+// that the calling test fails if any of them receive a request.
+func switchBackendsErrorOnRequest(t *testing.T, backends []*CDNBackendServer) {
+	for _, backend := range backends {
+		name := backend.Name
+		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Server %s received request and it shouldn't have", name)
+			w.Write([]byte(name))
+		})
+	}
+}
+
+// checkForSkipHTTP2 skips the calling test if the http2 flag hasn't been
+// set.
+func checkForSkipHTTP2(t *testing.T) {
+	if !*http2 {
+		t.Skip("HTTP/2 tests require -http2")
+	}
+}
+
 // ResetBackends resets all backends, ensuring that they are started, have the
 // default handler function, and that the edge considers them healthy. It may
 // take some time because we need to receive and respond to enough probe health
@@ -297,14 +736,58 @@ func waitForBackend(expectedBackendName string) error {
 // Callback function to modify complete response.
 type responseCallback func(w http.ResponseWriter)
 
+// testResponseIDHeader is used by writeTestResponse to identify responses
+// with status codes that don't permit a body.
+const testResponseIDHeader = "Test-Response-ID"
+
+// statusAllowsBody reports whether a response with the given status code
+// may include a body:
+// http://tools.ietf.org/html/rfc7230#section-3.3.3
+func statusAllowsBody(statusCode int) bool {
+	return statusCode >= 200 &&
+		statusCode != http.StatusNoContent &&
+		statusCode != http.StatusNotModified
+}
+
+// writeTestResponse writes a response from origin with the given status
+// code that can be identified by readTestResponseID. The ID is written as
+// the body or, if the status code doesn't permit a body, in a header. A 206
+// response is given a `Content-Range` covering the whole body.
+func writeTestResponse(w http.ResponseWriter, statusCode int, id string) {
+	if !statusAllowsBody(statusCode) {
+		w.Header().Set(testResponseIDHeader, id)
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	if statusCode == http.StatusPartialContent {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(id)-1, len(id)))
+	}
+
+	w.WriteHeader(statusCode)
+	w.Write([]byte(id))
+}
+
+// readTestResponseID returns the ID of a response written by
+// writeTestResponse.
+func readTestResponseID(resp *http.Response) (string, error) {
+	if !statusAllowsBody(resp.StatusCode) {
+		return resp.Header.Get(testResponseIDHeader), nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
 // Wrapper for testRequestsCachedDuration() with a respTTL of zero.
 // Meaning that the cached object doesn't expire.
 func testRequestsCachedIndefinite(
 	t *testing.T,
 	req *http.Request,
 	respCB responseCallback,
+	statusCode int,
 ) {
-	testRequestsCachedDuration(t, req, respCB, time.Duration(0))
+	testRequestsCachedDuration(t, req, respCB, time.Duration(0), statusCode)
 }
 
 // Helper function to make three requests and test responses. If respTTL is:
@@ -316,13 +799,15 @@ func testRequestsCachedIndefinite(
 //		delay of respTTL + a buffer a third response should get a new response
 //		directly from origin.
 //
-// A responseCallback, if not nil, will be called to modify the response
-// before calling Write(body).
+// Origin responds with statusCode, which every response must match. A
+// responseCallback, if not nil, will be called to modify the response
+// headers before the status code and body are written.
 func testRequestsCachedDuration(
 	t *testing.T,
 	req *http.Request,
 	respCB responseCallback,
 	respTTL time.Duration,
+	statusCode int,
 ) {
 	const responseCached = "first response"
 	const responseNotCached = "subsequent response"
@@ -344,9 +829,9 @@ func testRequestsCachedDuration(
 		}
 
 		if requestsReceivedCount == 0 {
-			w.Write([]byte(responseCached))
+			writeTestResponse(w, statusCode, responseCached)
 		} else {
-			w.Write([]byte(responseNotCached))
+			writeTestResponse(w, statusCode, responseNotCached)
 		}
 
 		requestsReceivedCount++
@@ -360,7 +845,16 @@ func testRequestsCachedDuration(
 		resp := RoundTripCheckError(t, req)
 		defer resp.Body.Close()
 
-		body, err := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != statusCode {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount,
+				statusCode,
+				resp.StatusCode,
+			)
+		}
+
+		receivedBody, err := readTestResponseID(resp)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -372,7 +866,7 @@ func testRequestsCachedDuration(
 			expectedBody = responseCached
 		}
 
-		if receivedBody := string(body); receivedBody != expectedBody {
+		if receivedBody != expectedBody {
 			t.Errorf(
 				"Request %d received incorrect response body. Expected %q, got %q",
 				requestCount,
@@ -391,14 +885,19 @@ func testRequestsCachedDuration(
 	}
 }
 
-// Callback function to modify response headers.
-type responseHeaderCallback func(h http.Header)
-
-// Helper function to make three requests and verify that we get three
-// unique and uncached responses back. A responseHeaderCallback, if not nil,
-// will be called to modify the response headers.
-func testThreeRequestsNotCached(t *testing.T, req *http.Request, headerCB responseHeaderCallback) {
-	requestsReceivedCount := 0
+// testRequestsNotCached makes three requests and verifies that we get
+// three unique and uncached responses back, each with statusCode. It also
+// asserts that every request reached origin, rather than inferring it from
+// the response bodies alone. A responseCallback, if not nil, will be called
+// to modify the response headers before the status code and body are
+// written.
+func testRequestsNotCached(
+	t *testing.T,
+	req *http.Request,
+	respCB responseCallback,
+	statusCode int,
+) {
+	var originRequests RequestRecorder
 	responseBodies := []string{
 		"first response",
 		"second response",
@@ -406,23 +905,38 @@ func testThreeRequestsNotCached(t *testing.T, req *http.Request, headerCB respon
 	}
 
 	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-		if headerCB != nil {
-			headerCB(w.Header())
+		requestsReceivedCount := originRequests.Count()
+		originRequests.Record()
+
+		if respCB != nil {
+			respCB(w)
+		}
+		if requestsReceivedCount < len(responseBodies) {
+			writeTestResponse(w, statusCode, responseBodies[requestsReceivedCount])
+		} else {
+			w.WriteHeader(statusCode)
 		}
-		w.Write([]byte(responseBodies[requestsReceivedCount]))
-		requestsReceivedCount++
 	})
 
 	for requestCount, expectedBody := range responseBodies {
 		resp := RoundTripCheckError(t, req)
 		defer resp.Body.Close()
 
-		body, err := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != statusCode {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount+1,
+				statusCode,
+				resp.StatusCode,
+			)
+		}
+
+		receivedBody, err := readTestResponseID(resp)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		if receivedBody := string(body); receivedBody != expectedBody {
+		if receivedBody != expectedBody {
 			t.Errorf(
 				"Request %d received incorrect response body. Expected %q, got %q",
 				requestCount+1,
@@ -431,6 +945,35 @@ func testThreeRequestsNotCached(t *testing.T, req *http.Request, headerCB respon
 			)
 		}
 	}
+
+	if count := originRequests.Count(); count != len(responseBodies) {
+		t.Errorf(
+			"Origin received the wrong number of requests. Expected %d, got %d",
+			len(responseBodies),
+			count,
+		)
+	}
+}
+
+// testResponseHeaderStripped configures origin to respond with the given
+// header name and value. It then makes a request and asserts that the
+// header was removed by the edge before the response was delivered to the
+// client.
+func testResponseHeaderStripped(t *testing.T, req *http.Request, headerName string, headerValue string) {
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerName, headerValue)
+	})
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if vals, ok := resp.Header[http.CanonicalHeaderKey(headerName)]; ok {
+		t.Errorf(
+			"Received %q header that should have been stripped. Got %q",
+			headerName,
+			vals,
+		)
+	}
 }
 
 // testResponseNotManipulated configures origin to respond to a request with
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"reflect"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 // CDNBackendServer instance should be ready to serve requests when test
@@ -59,6 +63,35 @@ func TestHelpersCDNBackendServerProbes(t *testing.T) {
 	}
 }
 
+// CDNBackendServer should pass health check requests to an observer set by
+// ObserveProbes, whilst still responding to them.
+func TestHelpersCDNBackendServerObserveProbes(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedPath = "/probe-path"
+	var observedPath string
+
+	originServer.ObserveProbes(func(r *http.Request) {
+		observedPath = r.URL.Path
+	})
+
+	url := originServer.server.URL + expectedPath
+	req, _ := http.NewRequest("HEAD", url, nil)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 || resp.Header.Get("PING") != "PONG" {
+		t.Error("HEAD request served incorrectly")
+	}
+	if observedPath != expectedPath {
+		t.Errorf(
+			"Observer received incorrect path. Expected %q, got %q",
+			expectedPath,
+			observedPath,
+		)
+	}
+}
+
 func TestHelpersCDNServeStop(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
@@ -108,6 +141,55 @@ func TestHelpersCDNServeStop(t *testing.T) {
 	}
 }
 
+// CDNBackendServer should accept requests but not respond to them after
+// HangRequests has been called, whilst still responding to health checks.
+// Stopping the server should release any hung requests.
+func TestHelpersCDNBackendServerHang(t *testing.T) {
+	const clientTimeout = time.Duration(100 * time.Millisecond)
+	const stopTimeout = time.Second
+
+	backend := CDNBackendServer{
+		Name: "test",
+		Port: 0,
+	}
+
+	backend.Start()
+	backend.HangRequests()
+
+	hangClient := &http.Transport{
+		ResponseHeaderTimeout: clientTimeout,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+
+	req, _ := http.NewRequest("HEAD", backend.server.URL+"/", nil)
+	resp, err := hangClient.RoundTrip(req)
+	if err != nil {
+		t.Fatal("Health check request failed: ", err)
+	}
+	resp.Body.Close()
+
+	req, _ = http.NewRequest("GET", backend.server.URL+"/"+NewUUID(), nil)
+	resp, err = hangClient.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Error("Request received a response and it shouldn't have")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		backend.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(stopTimeout):
+		t.Errorf("Stop() didn't release hung requests within %s", stopTimeout)
+	}
+}
+
 // CDNBackendServer should assign a random port when started for the first
 // time with a port of 0. Subsequent starts should retain the assigned port
 // from the first start.
@@ -261,6 +343,88 @@ func TestHelpersCDNBackendServerTLSCustomCert(t *testing.T) {
 	}
 }
 
+// CDNBackendServer should refuse connections from clients that don't
+// present a certificate if `ClientCAs` is passed.
+func TestHelpersCDNBackendServerTLSClientCAs(t *testing.T) {
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(customCert) {
+		t.Fatal("Unable to parse custom cert")
+	}
+
+	backend := CDNBackendServer{
+		Name:      "test",
+		Port:      0,
+		ClientCAs: clientCAs,
+	}
+
+	backend.Start()
+	defer backend.Stop()
+
+	mtlsClient := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+
+	req, _ := http.NewRequest("HEAD", backend.server.URL+"/", nil)
+	resp, err := mtlsClient.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Error("Request without a client certificate received a response and it shouldn't have")
+	}
+}
+
+// WriteRawResponse should write exactly the bytes given to the client,
+// without any of the headers or framing that net/http would add, and then
+// close the connection.
+func TestHelpersWriteRawResponse(t *testing.T) {
+	const rawRequest = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	expectedResponse := []byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\ntoo short")
+
+	backend := CDNBackendServer{
+		Name: "test",
+		Port: 0,
+	}
+
+	backend.Start()
+	defer backend.Stop()
+
+	backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		if err := WriteRawResponse(w, expectedResponse); err != nil {
+			t.Error(err)
+		}
+	})
+
+	conn, err := tls.Dial(
+		"tcp",
+		backend.server.Listener.Addr().String(),
+		&tls.Config{
+			InsecureSkipVerify: true,
+		},
+	)
+	if err != nil {
+		t.Fatal("Error connecting: ", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(rawRequest)); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(response, expectedResponse) {
+		t.Errorf(
+			"Incorrect raw response. Expected %q, got %q",
+			expectedResponse,
+			response,
+		)
+	}
+}
+
 // generated from src/pkg/crypto/tls:
 // go run generate_cert.go --rsa-bits 512 --host 203.0.113.10,cdn-acceptance-tests.example.com --ca --start-date "Jan 1 00:00:00 1970" --duration=1000000h
 var customCert = []byte(`-----BEGIN CERTIFICATE-----
@@ -2,8 +2,10 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -11,16 +13,63 @@ import (
 )
 
 var (
-	backendCert   = flag.String("backendCert", "", "Override self-signed cert for backend TLS")
-	backendKey    = flag.String("backendKey", "", "Override self-signed cert, must be provided with -backendCert")
-	backupPort1   = flag.Int("backupPort1", 8081, "Backup1 port to listen on for requests")
-	backupPort2   = flag.Int("backupPort2", 8082, "Backup2 port to listen on for requests")
-	edgeHost      = flag.String("edgeHost", "", "Hostname of edge")
-	originPort    = flag.Int("originPort", 8080, "Origin port to listen on for requests")
-	skipFailover  = flag.Bool("skipFailover", false, "Skip failover tests and only setup the origin backend")
-	skipVerifyTLS = flag.Bool("skipVerifyTLS", false, "Skip TLS cert verification if set")
-	usage         = flag.Bool("usage", false, "Print usage")
-	vendor        = flag.String("vendor", "", "Name of vendor; run tests specific to vendor")
+	aclAllowed           = flag.Bool("aclAllowed", false, "IP address that tests are run from is on the allow list for -aclPath")
+	aclPath              = flag.String("aclPath", "", "Path on edge that is restricted to an IP allow list; ACL tests skipped if not set")
+	ageTolerance         = flag.Duration("ageTolerance", time.Second, "Allowed skew between Age headers and wall-clock age")
+	backendCert          = flag.String("backendCert", "", "Override self-signed cert for backend TLS")
+	backendKey           = flag.String("backendKey", "", "Override self-signed cert, must be provided with -backendCert")
+	backendHosts         = flag.String("backendHosts", "", "Comma-separated Host headers that origin and each backup should receive, in priority order; defaults to -edgeHost")
+	backendMarkerHeader  = flag.String("backendMarkerHeader", "", "Request header that edge sets to the name of the backend it sends each request to; marker tests skipped if not set")
+	backupPort1          = flag.Int("backupPort1", 8081, "Backup1 port to listen on for requests")
+	backupPort2          = flag.Int("backupPort2", 8082, "Backup2 port to listen on for requests")
+	betweenBytesTimeout  = flag.Duration("betweenBytesTimeout", 10*time.Second, "Period edge waits between bytes of a backend's response body before giving up")
+	cacheSize            = flag.Int64("cacheSize", 0, "Approximate size in MB of edge's cache storage; eviction tests skipped if not set")
+	cacheStatusHeader    = flag.String("cacheStatusHeader", "", "Response header containing HIT/MISS from edge; defaults to the vendor's")
+	cbcRejected          = flag.Bool("cbcRejected", false, "Edge rejects handshakes that only offer CBC cipher suites, which many still accept for legacy clients")
+	certExpiryDays       = flag.Int("certExpiryDays", 30, "Minimum number of days before edge's certificates expire")
+	certHostnames        = flag.String("certHostnames", "", "Comma-separated hostnames, such as apex and www, that edge's certificate should cover; defaults to -edgeHost")
+	conditionalRequests  = flag.Bool("conditionalRequests", false, "Edge revalidates expired objects with conditional requests to backends; conditional revalidation tests skipped if not set")
+	edgeHost             = flag.String("edgeHost", "", "Hostname of edge")
+	egressIP             = flag.String("egressIP", "", "Public IP address that tests are run from; client IP is only checked against it if set")
+	firstByteTimeout     = flag.Duration("firstByteTimeout", 15*time.Second, "Period edge waits for the first byte from a backend before failing over")
+	graceWindow          = flag.Duration("graceWindow", 0, "Period edge serves stale objects for when backends are down; grace expiry tests skipped if not set")
+	healthCheckWindow    = flag.Duration("healthCheckWindow", 30*time.Second, "Period within which edge should consider a recovered backend healthy again")
+	hstsMaxAge           = flag.Duration("hstsMaxAge", 0, "Max-age of Strict-Transport-Security header that edge adds; HSTS tests skipped if not set")
+	hstsSubDomains       = flag.Bool("hstsSubDomains", false, "Edge's Strict-Transport-Security header includes subdomains")
+	http2                = flag.Bool("http2", false, "Make requests to edge over HTTP/2, negotiated with ALPN; HTTP/2 tests skipped if not set")
+	http3                = flag.Bool("http3", false, "Edge supports HTTP/3 and advertises it with Alt-Svc")
+	ipv6                 = flag.Bool("ipv6", false, "Connect to edge over IPv6, using its AAAA record; IPv6 tests skipped if not set")
+	largeObjects         = flag.Bool("largeObjects", false, "Run slow tests that transfer objects of up to 2GB")
+	negativeTTL          = flag.Duration("negativeTTL", 0, "TTL that edge caches 5xx responses for, if configured to")
+	ocspStapling         = flag.Bool("ocspStapling", false, "Edge staples OCSP responses to TLS handshakes; OCSP stapling test skipped if not set")
+	originClientCA       = flag.String("originClientCA", "", "CA cert that edge's client cert is signed by; backends require mutual TLS and mTLS tests are skipped if not set")
+	originPort           = flag.Int("originPort", 8080, "Origin port to listen on for requests")
+	originSecret         = flag.String("originSecret", "", "Value of request header that edge sends to backends to authenticate itself; shared secret tests skipped if not set")
+	originSecretName     = flag.String("originSecretName", "X-Origin-Secret", "Name of request header used to send -originSecret")
+	plainHTTP            = flag.Bool("plainHTTP", false, "Edge serves plain HTTP requests rather than redirecting them to HTTPS; HTTP cache key test skipped if not set")
+	probeInterval        = flag.Duration("probeInterval", 10*time.Second, "Interval at which edge sends health check probes to each backend")
+	purgeKey             = flag.String("purgeKey", "", "Credentials sent with PURGE requests; purge tests are skipped if not set")
+	purgeKeyName         = flag.String("purgeKeyName", "Fastly-Key", "Name of request header used to send -purgeKey")
+	queryParamsSorted    = flag.Bool("queryParamsSorted", false, "Edge sorts query params so that their order doesn't affect the cache key")
+	rateLimit            = flag.Int("rateLimit", 0, "Number of requests in a burst from one client that edge serves before responding 429; rate limiting tests skipped if not set")
+	schemeSharesCache    = flag.Bool("schemeSharesCache", false, "Edge serves HTTP and HTTPS requests for the same URL from the same cached object")
+	signedURLKey         = flag.String("signedURLKey", "", "Key that edge verifies signed URLs for -signedURLPath with; signed URL tests skipped if not set")
+	signedURLPath        = flag.String("signedURLPath", "/signed/", "Path prefix on edge that requires signed URLs")
+	skipFailover         = flag.Bool("skipFailover", false, "Skip failover tests and only setup the origin backend")
+	skipVerifyTLS        = flag.Bool("skipVerifyTLS", false, "Skip TLS cert verification if set")
+	slowlorisConns       = flag.Int("slowlorisConns", 0, "Number of slow connections to hold open to edge; slowloris test skipped if not set")
+	sniRequired          = flag.Bool("sniRequired", false, "Edge rejects TLS handshakes without SNI, rather than serving a default cert")
+	staleMarker          = flag.String("staleMarker", "", "Response header and value prefix, as \"Name: value\", that edge marks objects served from stale with; used for Fastly, whose stale marking test is skipped if not set")
+	staleWhileRevalidate = flag.Bool("staleWhileRevalidate", false, "Edge revalidates stale objects asynchronously within the stale-while-revalidate window; test skipped if not set")
+	streaming            = flag.Bool("streaming", false, "Edge streams responses from backends to clients as they are received, rather than buffering them; streaming tests skipped if not set")
+	surrogateKeyPurgeURL = flag.String("surrogateKeyPurgeURL", "", "URL of vendor API to POST Surrogate-Key purges to, with %s for the key; Surrogate-Key purge test skipped if not set")
+	tlsMinVersion        = flag.String("tlsMinVersion", "", "Lowest TLS version that edge should accept; one of 1.0, 1.1, 1.2 or 1.3; protocol version tests skipped if not set")
+	trailers             = flag.Bool("trailers", false, "Edge passes response trailers from backends through to clients, rather than dropping them")
+	unknownHostStatus    = flag.Int("unknownHostStatus", 0, "Status code that edge responds with for Host headers not configured on the service; defaults to the vendor's, or any error")
+	usage                = flag.Bool("usage", false, "Print usage")
+	vendor               = flag.String("vendor", "", "Name of vendor; run tests specific to vendor")
+	verifyOriginTLS      = flag.Bool("verifyOriginTLS", false, "Edge verifies certs of backends, so must not connect to those with invalid certs")
+	websockets           = flag.Bool("websockets", false, "Edge passes WebSocket connections through to backends, rather than refusing to upgrade them")
 	// This only works with tests that use RoundTripCheckError(), that either
 	// are either failing or run with the -v flag.
 	debugResp = flag.Bool("debugResp", false, "Log responses for debugging")
@@ -64,8 +113,17 @@ func init() {
 	switch *vendor {
 	case "cloudflare":
 		vendorCloudflare = true
+		if *cacheStatusHeader == "" {
+			*cacheStatusHeader = "CF-Cache-Status"
+		}
 	case "fastly":
 		vendorFastly = true
+		if *cacheStatusHeader == "" {
+			*cacheStatusHeader = "X-Cache"
+		}
+		if *unknownHostStatus == 0 {
+			*unknownHostStatus = http.StatusInternalServerError
+		}
 	case "":
 		log.Fatalln("No vendor specified; must be either 'cloudflare' or 'fastly'")
 	default:
@@ -79,7 +137,8 @@ func init() {
 	client = &http.Transport{
 		ResponseHeaderTimeout: requestTimeout,
 		TLSClientConfig:       tlsOptions,
-		Dial:                  NewCachedDial(*edgeHost),
+		Dial:                  NewCachedDial(*edgeHost, *ipv6),
+		ForceAttemptHTTP2:     *http2,
 	}
 
 	var backendCerts []tls.Certificate
@@ -93,10 +152,24 @@ func init() {
 		}
 	}
 
+	var backendClientCAs *x509.CertPool
+	if *originClientCA != "" {
+		pem, err := ioutil.ReadFile(*originClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		backendClientCAs = x509.NewCertPool()
+		if !backendClientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certs found in -originClientCA %q", *originClientCA)
+		}
+	}
+
 	originServer = &CDNBackendServer{
-		Name:     "origin",
-		Port:     *originPort,
-		TLSCerts: backendCerts,
+		Name:      "origin",
+		Port:      *originPort,
+		TLSCerts:  backendCerts,
+		ClientCAs: backendClientCAs,
 	}
 	backendsByPriority = []*CDNBackendServer{
 		originServer,
@@ -104,14 +177,16 @@ func init() {
 
 	if !*skipFailover {
 		backupServer1 = &CDNBackendServer{
-			Name:     "backup1",
-			Port:     *backupPort1,
-			TLSCerts: backendCerts,
+			Name:      "backup1",
+			Port:      *backupPort1,
+			TLSCerts:  backendCerts,
+			ClientCAs: backendClientCAs,
 		}
 		backupServer2 = &CDNBackendServer{
-			Name:     "backup2",
-			Port:     *backupPort2,
-			TLSCerts: backendCerts,
+			Name:      "backup2",
+			Port:      *backupPort2,
+			TLSCerts:  backendCerts,
+			ClientCAs: backendClientCAs,
 		}
 		backendsByPriority = append(
 			backendsByPriority,
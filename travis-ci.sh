@@ -7,7 +7,7 @@ sudo FACTER_varnish_backend_address="127.0.0.1" \
   --modulepath mock_cdn_config/modules \
   mock_cdn_config/manifests/site.pp || [ $? -eq 2 ]
 
-go test -edgeHost 127.0.0.1 -skipVerifyTLS -v -vendor=fastly
+go test -edgeHost 127.0.0.1 -skipVerifyTLS -v -vendor=fastly -purgeKey=mock-purge-key -backendMarkerHeader=X-Backend -originSecret=mock-origin-secret -egressIP=127.0.0.1 -staleMarker="Warning: 110" -surrogateKeyPurgeURL=https://127.0.0.1/service/mock/purge/%s
 
 go get code.google.com/p/go.tools/cmd/vet
 go vet